@@ -42,6 +42,7 @@ func Backend(conf *logical.BackendConfig) *databaseBackend {
 			pathRoles(&b),
 			pathCredsCreate(&b),
 			pathResetConnection(&b),
+			pathSweep(&b),
 		},
 
 		Secrets: []*framework.Secret{
@@ -99,7 +100,7 @@ func (b *databaseBackend) createDBObj(ctx context.Context, s logical.Storage, na
 		return nil, err
 	}
 
-	db, err = dbplugin.PluginFactory(ctx, config.PluginName, b.System(), b.logger)
+	db, err = dbplugin.PluginFactoryWithConfig(ctx, config.PluginName, b.System(), b.logger, config.factoryConfig())
 	if err != nil {
 		return nil, err
 	}
@@ -233,6 +233,153 @@ func TestBackend_config_connection(t *testing.T) {
 	}
 }
 
+func TestBackend_config_connectionLimits(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = sys
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup(context.Background())
+
+	configReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/plugin-test",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"connection_url":            "sample_connection_url",
+			"plugin_name":               "postgresql-database-plugin",
+			"verify_connection":         false,
+			"max_concurrent_operations": -1,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), configReq)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response, got err:%v resp:%#v", err, resp)
+	}
+
+	configReq.Data["max_concurrent_operations"] = 4
+	configReq.Data["max_credentials"] = -1
+	resp, err = b.HandleRequest(context.Background(), configReq)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response, got err:%v resp:%#v", err, resp)
+	}
+
+	configReq.Data["max_credentials"] = 100
+	configReq.Data["revocation_cache_ttl"] = "1m"
+	configReq.Data["replica_connection_urls"] = "sample_replica_connection_url"
+	resp, err = b.HandleRequest(context.Background(), configReq)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	configReq.Operation = logical.ReadOperation
+	resp, err = b.HandleRequest(context.Background(), configReq)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	// The limits are not passed to the plugin as connection details
+	expected := map[string]interface{}{
+		"connection_url": "sample_connection_url",
+	}
+	delete(resp.Data["connection_details"].(map[string]interface{}), "name")
+	if !reflect.DeepEqual(expected, resp.Data["connection_details"]) {
+		t.Fatalf("bad: expected:%#v\nactual:%#v\n", expected, resp.Data["connection_details"])
+	}
+	if resp.Data["max_concurrent_operations"] != 4 {
+		t.Fatalf("bad: max_concurrent_operations: %#v", resp.Data["max_concurrent_operations"])
+	}
+	if resp.Data["max_credentials"] != 100 {
+		t.Fatalf("bad: max_credentials: %#v", resp.Data["max_credentials"])
+	}
+	if resp.Data["revocation_cache_ttl"] != float64(60) {
+		t.Fatalf("bad: revocation_cache_ttl: %#v", resp.Data["revocation_cache_ttl"])
+	}
+	if !reflect.DeepEqual(resp.Data["replica_connection_urls"], []string{"sample_replica_connection_url"}) {
+		t.Fatalf("bad: replica_connection_urls: %#v", resp.Data["replica_connection_urls"])
+	}
+}
+
+func TestBackend_sweep(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = sys
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Cleanup(context.Background())
+
+	// Configure a connection to a database which can't be reached
+	req := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/plugin-test",
+		Storage:   config.StorageView,
+		Data: map[string]interface{}{
+			"connection_url":    "postgres://localhost:1/?sslmode=disable&connect_timeout=1",
+			"plugin_name":       "postgresql-database-plugin",
+			"verify_connection": false,
+		},
+	}
+	resp, err := b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	req.Path = "roles/plugin-role-test"
+	req.Data = map[string]interface{}{
+		"db_name":             "plugin-test",
+		"creation_statements": testRole,
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+
+	// Usernames are required
+	req.Path = "sweep/plugin-role-test"
+	req.Data = map[string]interface{}{}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response, got err:%v resp:%#v", err, resp)
+	}
+
+	// The role must exist
+	req.Path = "sweep/unknown"
+	req.Data = map[string]interface{}{
+		"usernames": "v-foo",
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected an error response, got err:%v resp:%#v", err, resp)
+	}
+
+	// Each user which couldn't be revoked is reported
+	req.Path = "sweep/plugin-role-test"
+	req.Data = map[string]interface{}{
+		"usernames": "v-foo,v-bar",
+	}
+	resp, err = b.HandleRequest(context.Background(), req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("err:%s resp:%#v\n", err, resp)
+	}
+	errs := resp.Data["errors"].(map[string]interface{})
+	if len(errs) != 2 || errs["v-foo"] == nil || errs["v-bar"] == nil {
+		t.Fatalf("bad: errors: %#v", errs)
+	}
+	if len(resp.Warnings) != 1 {
+		t.Fatalf("bad: warnings: %#v", resp.Warnings)
+	}
+}
+
 func TestBackend_basic(t *testing.T) {
 	cluster, sys := getCluster(t)
 	defer cluster.Cleanup()
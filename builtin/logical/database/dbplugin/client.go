@@ -28,6 +28,31 @@ func (dc *DatabasePluginClient) Close() error {
 	return err
 }
 
+// Version returns the version reported by the plugin. It is defined here
+// since embedding the Database interface doesn't expose the Version method
+// of the RPC clients.
+func (dc *DatabasePluginClient) Version() (string, error) {
+	versioner, ok := dc.Database.(Versioner)
+	if !ok {
+		return "", errors.New("plugin client doesn't report versions")
+	}
+
+	return versioner.Version()
+}
+
+// RenewUsers renews the users of the given requests in a single call to the
+// plugin. Like Version, the embedded Database doesn't expose it.
+func (dc *DatabasePluginClient) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, dc.Database, requests)
+}
+
+// supportsBatchRenewal returns whether the plugin may renew users in
+// batches itself
+func (dc *DatabasePluginClient) supportsBatchRenewal() bool {
+	supporter, ok := dc.Database.(batchRenewalSupporter)
+	return ok && supporter.supportsBatchRenewal()
+}
+
 // newPluginClient returns a databaseRPCClient with a connection to a running
 // plugin. The client is wrapped in a DatabasePluginClient object to ensure the
 // plugin is killed on call of Close().
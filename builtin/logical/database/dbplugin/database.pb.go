@@ -16,6 +16,9 @@ It has these top-level messages:
 	UsernameConfig
 	CreateUserResponse
 	TypeResponse
+	VersionResponse
+	RenewUsersRequest
+	RenewUsersResponse
 	Empty
 */
 package dbplugin
@@ -265,6 +268,54 @@ func (m *Empty) String() string            { return proto.CompactTextString(m) }
 func (*Empty) ProtoMessage()               {}
 func (*Empty) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
 
+type VersionResponse struct {
+	Version string `protobuf:"bytes,1,opt,name=version" json:"version,omitempty"`
+}
+
+func (m *VersionResponse) Reset()                    { *m = VersionResponse{} }
+func (m *VersionResponse) String() string            { return proto.CompactTextString(m) }
+func (*VersionResponse) ProtoMessage()               {}
+func (*VersionResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *VersionResponse) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+type RenewUsersRequest struct {
+	Requests []*RenewUserRequest `protobuf:"bytes,1,rep,name=requests" json:"requests,omitempty"`
+}
+
+func (m *RenewUsersRequest) Reset()                    { *m = RenewUsersRequest{} }
+func (m *RenewUsersRequest) String() string            { return proto.CompactTextString(m) }
+func (*RenewUsersRequest) ProtoMessage()               {}
+func (*RenewUsersRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *RenewUsersRequest) GetRequests() []*RenewUserRequest {
+	if m != nil {
+		return m.Requests
+	}
+	return nil
+}
+
+type RenewUsersResponse struct {
+	Errors []string `protobuf:"bytes,1,rep,name=errors" json:"errors,omitempty"`
+}
+
+func (m *RenewUsersResponse) Reset()                    { *m = RenewUsersResponse{} }
+func (m *RenewUsersResponse) String() string            { return proto.CompactTextString(m) }
+func (*RenewUsersResponse) ProtoMessage()               {}
+func (*RenewUsersResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *RenewUsersResponse) GetErrors() []string {
+	if m != nil {
+		return m.Errors
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*InitializeRequest)(nil), "dbplugin.InitializeRequest")
 	proto.RegisterType((*CreateUserRequest)(nil), "dbplugin.CreateUserRequest")
@@ -275,6 +326,9 @@ func init() {
 	proto.RegisterType((*CreateUserResponse)(nil), "dbplugin.CreateUserResponse")
 	proto.RegisterType((*TypeResponse)(nil), "dbplugin.TypeResponse")
 	proto.RegisterType((*Empty)(nil), "dbplugin.Empty")
+	proto.RegisterType((*VersionResponse)(nil), "dbplugin.VersionResponse")
+	proto.RegisterType((*RenewUsersRequest)(nil), "dbplugin.RenewUsersRequest")
+	proto.RegisterType((*RenewUsersResponse)(nil), "dbplugin.RenewUsersResponse")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -294,6 +348,8 @@ type DatabaseClient interface {
 	RevokeUser(ctx context.Context, in *RevokeUserRequest, opts ...grpc.CallOption) (*Empty, error)
 	Initialize(ctx context.Context, in *InitializeRequest, opts ...grpc.CallOption) (*Empty, error)
 	Close(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	Version(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*VersionResponse, error)
+	RenewUsers(ctx context.Context, in *RenewUsersRequest, opts ...grpc.CallOption) (*RenewUsersResponse, error)
 }
 
 type databaseClient struct {
@@ -358,6 +414,24 @@ func (c *databaseClient) Close(ctx context.Context, in *Empty, opts ...grpc.Call
 	return out, nil
 }
 
+func (c *databaseClient) Version(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*VersionResponse, error) {
+	out := new(VersionResponse)
+	err := grpc.Invoke(ctx, "/dbplugin.Database/Version", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *databaseClient) RenewUsers(ctx context.Context, in *RenewUsersRequest, opts ...grpc.CallOption) (*RenewUsersResponse, error) {
+	out := new(RenewUsersResponse)
+	err := grpc.Invoke(ctx, "/dbplugin.Database/RenewUsers", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for Database service
 
 type DatabaseServer interface {
@@ -367,6 +441,8 @@ type DatabaseServer interface {
 	RevokeUser(context.Context, *RevokeUserRequest) (*Empty, error)
 	Initialize(context.Context, *InitializeRequest) (*Empty, error)
 	Close(context.Context, *Empty) (*Empty, error)
+	Version(context.Context, *Empty) (*VersionResponse, error)
+	RenewUsers(context.Context, *RenewUsersRequest) (*RenewUsersResponse, error)
 }
 
 func RegisterDatabaseServer(s *grpc.Server, srv DatabaseServer) {
@@ -481,6 +557,42 @@ func _Database_Close_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Database_Version_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DatabaseServer).Version(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dbplugin.Database/Version",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DatabaseServer).Version(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Database_RenewUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DatabaseServer).RenewUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/dbplugin.Database/RenewUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DatabaseServer).RenewUsers(ctx, req.(*RenewUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Database_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "dbplugin.Database",
 	HandlerType: (*DatabaseServer)(nil),
@@ -509,6 +621,14 @@ var _Database_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Close",
 			Handler:    _Database_Close_Handler,
 		},
+		{
+			MethodName: "Version",
+			Handler:    _Database_Version_Handler,
+		},
+		{
+			MethodName: "RenewUsers",
+			Handler:    _Database_RenewUsers_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "builtin/logical/database/dbplugin/database.proto",
@@ -517,40 +637,45 @@ var _Database_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("builtin/logical/database/dbplugin/database.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 548 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x54, 0xcf, 0x6e, 0xd3, 0x4e,
-	0x10, 0x96, 0xdb, 0xb4, 0xbf, 0x64, 0x5a, 0x35, 0xc9, 0xfe, 0x4a, 0x15, 0x19, 0x24, 0x22, 0x9f,
-	0x5a, 0x21, 0xd9, 0xa8, 0xe5, 0x80, 0xb8, 0xa1, 0x14, 0x21, 0x24, 0x94, 0x83, 0x69, 0x25, 0x6e,
-	0xd1, 0xda, 0x99, 0x44, 0xab, 0x3a, 0xbb, 0xc6, 0xbb, 0x4e, 0x09, 0x4f, 0xc3, 0xe3, 0x70, 0xe2,
-	0x1d, 0x78, 0x13, 0xe4, 0x75, 0xd6, 0xbb, 0xf9, 0x73, 0xab, 0xb8, 0x79, 0x66, 0xbe, 0x6f, 0xf6,
-	0xf3, 0xb7, 0x33, 0x0b, 0xaf, 0x93, 0x92, 0x65, 0x8a, 0xf1, 0x28, 0x13, 0x73, 0x96, 0xd2, 0x2c,
-	0x9a, 0x52, 0x45, 0x13, 0x2a, 0x31, 0x9a, 0x26, 0x79, 0x56, 0xce, 0x19, 0x6f, 0x32, 0x61, 0x5e,
-	0x08, 0x25, 0x48, 0xdb, 0x14, 0xfc, 0x97, 0x73, 0x21, 0xe6, 0x19, 0x46, 0x3a, 0x9f, 0x94, 0xb3,
-	0x48, 0xb1, 0x05, 0x4a, 0x45, 0x17, 0x79, 0x0d, 0x0d, 0xbe, 0x42, 0xff, 0x13, 0x67, 0x8a, 0xd1,
-	0x8c, 0xfd, 0xc0, 0x18, 0xbf, 0x95, 0x28, 0x15, 0xb9, 0x80, 0xe3, 0x54, 0xf0, 0x19, 0x9b, 0x0f,
-	0xbc, 0xa1, 0x77, 0x79, 0x1a, 0xaf, 0x23, 0xf2, 0x0a, 0xfa, 0x4b, 0x2c, 0xd8, 0x6c, 0x35, 0x49,
-	0x05, 0xe7, 0x98, 0x2a, 0x26, 0xf8, 0xe0, 0x60, 0xe8, 0x5d, 0xb6, 0xe3, 0x5e, 0x5d, 0x18, 0x35,
-	0xf9, 0xe0, 0x97, 0x07, 0xfd, 0x51, 0x81, 0x54, 0xe1, 0xbd, 0xc4, 0xc2, 0xb4, 0x7e, 0x03, 0x20,
-	0x15, 0x55, 0xb8, 0x40, 0xae, 0xa4, 0x6e, 0x7f, 0x72, 0x7d, 0x1e, 0x1a, 0xbd, 0xe1, 0x97, 0xa6,
-	0x16, 0x3b, 0x38, 0xf2, 0x1e, 0xba, 0xa5, 0xc4, 0x82, 0xd3, 0x05, 0x4e, 0xd6, 0xca, 0x0e, 0x34,
-	0x75, 0x60, 0xa9, 0xf7, 0x6b, 0xc0, 0x48, 0xd7, 0xe3, 0xb3, 0x72, 0x23, 0x26, 0xef, 0x00, 0xf0,
-	0x7b, 0xce, 0x0a, 0xaa, 0x45, 0x1f, 0x6a, 0xb6, 0x1f, 0xd6, 0xf6, 0x84, 0xc6, 0x9e, 0xf0, 0xce,
-	0xd8, 0x13, 0x3b, 0xe8, 0xe0, 0xa7, 0x07, 0xbd, 0x18, 0x39, 0x3e, 0x3e, 0xfd, 0x4f, 0x7c, 0x68,
-	0x1b, 0x61, 0xfa, 0x17, 0x3a, 0x71, 0x13, 0x3f, 0x49, 0x22, 0x42, 0x3f, 0xc6, 0xa5, 0x78, 0xc0,
-	0x7f, 0x2a, 0x31, 0xf8, 0xed, 0x01, 0x58, 0x1a, 0x89, 0xe0, 0xff, 0xb4, 0xba, 0x62, 0x26, 0xf8,
-	0x64, 0xeb, 0xa4, 0x4e, 0x4c, 0x4c, 0xc9, 0x21, 0xdc, 0xc0, 0xb3, 0x02, 0x97, 0x22, 0xdd, 0xa1,
-	0xd4, 0x07, 0x9d, 0xdb, 0xe2, 0xe6, 0x29, 0x85, 0xc8, 0xb2, 0x84, 0xa6, 0x0f, 0x2e, 0xe5, 0xb0,
-	0x3e, 0xc5, 0x94, 0x1c, 0xc2, 0x15, 0xf4, 0x8a, 0xea, 0xba, 0x5c, 0x74, 0x4b, 0xa3, 0xbb, 0x3a,
-	0x6f, 0xa1, 0xc1, 0x18, 0xce, 0x36, 0x07, 0x87, 0x0c, 0xe1, 0xe4, 0x96, 0xc9, 0x3c, 0xa3, 0xab,
-	0x71, 0xe5, 0x40, 0xfd, 0x2f, 0x6e, 0xaa, 0x32, 0x28, 0x16, 0x19, 0x8e, 0x1d, 0x83, 0x4c, 0x1c,
-	0x7c, 0x06, 0xe2, 0x0e, 0xbd, 0xcc, 0x05, 0x97, 0xb8, 0x61, 0xa9, 0xb7, 0x75, 0xeb, 0x3e, 0xb4,
-	0x73, 0x2a, 0xe5, 0xa3, 0x28, 0xa6, 0xa6, 0x9b, 0x89, 0x83, 0x00, 0x4e, 0xef, 0x56, 0x39, 0x36,
-	0x7d, 0x08, 0xb4, 0xd4, 0x2a, 0x37, 0x3d, 0xf4, 0x77, 0xf0, 0x1f, 0x1c, 0x7d, 0x58, 0xe4, 0x6a,
-	0x75, 0xfd, 0xe7, 0x00, 0xda, 0xb7, 0xeb, 0x87, 0x80, 0x44, 0xd0, 0xaa, 0x98, 0xa4, 0x6b, 0xaf,
-	0x5b, 0xa3, 0xfc, 0x0b, 0x9b, 0xd8, 0x68, 0xfd, 0x11, 0xc0, 0x0a, 0x27, 0xcf, 0x2d, 0x6a, 0x67,
-	0x87, 0xfd, 0x17, 0xfb, 0x8b, 0xeb, 0x46, 0x6f, 0xa1, 0xd3, 0xec, 0x0a, 0xf1, 0x2d, 0x74, 0x7b,
-	0x81, 0xfc, 0x6d, 0x69, 0xd5, 0xfc, 0xdb, 0x19, 0x76, 0x25, 0xec, 0x4c, 0xf6, 0x5e, 0xae, 0x7d,
-	0xc7, 0x5c, 0xee, 0xce, 0xeb, 0xb6, 0xcb, 0xbd, 0x82, 0xa3, 0x51, 0x26, 0xe4, 0x1e, 0xb3, 0xb6,
-	0x13, 0xc9, 0xb1, 0x5e, 0xc3, 0x9b, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x8c, 0x55, 0x84, 0x56,
-	0x94, 0x05, 0x00, 0x00,
+	// 631 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x54, 0xdd, 0x6e, 0xd3, 0x30,
+	0x14, 0x56, 0xd6, 0xfd, 0xb4, 0x67, 0xd3, 0xba, 0x9a, 0x31, 0x95, 0x30, 0x89, 0x29, 0x57, 0x9b,
+	0x86, 0x1a, 0xb4, 0x01, 0x42, 0xdc, 0xa1, 0x0e, 0x4d, 0x08, 0xb4, 0x0b, 0xb3, 0x21, 0xee, 0x26,
+	0x37, 0x3b, 0xab, 0xac, 0xa5, 0x76, 0xb0, 0xdd, 0x8e, 0xf2, 0x34, 0x3c, 0x0e, 0x57, 0xbc, 0x03,
+	0x6f, 0x82, 0xe2, 0xc4, 0x49, 0x9a, 0x54, 0xdc, 0x4c, 0xdc, 0xf9, 0x9c, 0xf3, 0x7d, 0xe7, 0xe7,
+	0xf3, 0xb1, 0xe1, 0xc5, 0x68, 0xca, 0x63, 0xc3, 0x45, 0x18, 0xcb, 0x31, 0x8f, 0x58, 0x1c, 0xde,
+	0x30, 0xc3, 0x46, 0x4c, 0x63, 0x78, 0x33, 0x4a, 0xe2, 0xe9, 0x98, 0x8b, 0xc2, 0x33, 0x48, 0x94,
+	0x34, 0x92, 0xb4, 0x5d, 0xc0, 0x7f, 0x36, 0x96, 0x72, 0x1c, 0x63, 0x68, 0xfd, 0xa3, 0xe9, 0x6d,
+	0x68, 0xf8, 0x04, 0xb5, 0x61, 0x93, 0x24, 0x83, 0x06, 0x5f, 0xa1, 0xf7, 0x41, 0x70, 0xc3, 0x59,
+	0xcc, 0x7f, 0x20, 0xc5, 0x6f, 0x53, 0xd4, 0x86, 0xec, 0xc1, 0x7a, 0x24, 0xc5, 0x2d, 0x1f, 0xf7,
+	0xbd, 0x03, 0xef, 0x70, 0x8b, 0xe6, 0x16, 0x39, 0x86, 0xde, 0x0c, 0x15, 0xbf, 0x9d, 0x5f, 0x47,
+	0x52, 0x08, 0x8c, 0x0c, 0x97, 0xa2, 0xbf, 0x72, 0xe0, 0x1d, 0xb6, 0xe9, 0x4e, 0x16, 0x18, 0x16,
+	0xfe, 0xe0, 0x97, 0x07, 0xbd, 0xa1, 0x42, 0x66, 0xf0, 0x4a, 0xa3, 0x72, 0xa9, 0x5f, 0x02, 0x68,
+	0xc3, 0x0c, 0x4e, 0x50, 0x18, 0x6d, 0xd3, 0x6f, 0x9e, 0xec, 0x0e, 0x5c, 0xbf, 0x83, 0xcf, 0x45,
+	0x8c, 0x56, 0x70, 0xe4, 0x1d, 0x74, 0xa7, 0x1a, 0x95, 0x60, 0x13, 0xbc, 0xce, 0x3b, 0x5b, 0xb1,
+	0xd4, 0x7e, 0x49, 0xbd, 0xca, 0x01, 0x43, 0x1b, 0xa7, 0xdb, 0xd3, 0x05, 0x9b, 0xbc, 0x05, 0xc0,
+	0xef, 0x09, 0x57, 0xcc, 0x36, 0xdd, 0xb2, 0x6c, 0x7f, 0x90, 0xc9, 0x33, 0x70, 0xf2, 0x0c, 0x2e,
+	0x9d, 0x3c, 0xb4, 0x82, 0x0e, 0x7e, 0x7a, 0xb0, 0x43, 0x51, 0xe0, 0xfd, 0xc3, 0x27, 0xf1, 0xa1,
+	0xed, 0x1a, 0xb3, 0x23, 0x74, 0x68, 0x61, 0x3f, 0xa8, 0x45, 0x84, 0x1e, 0xc5, 0x99, 0xbc, 0xc3,
+	0xff, 0xda, 0x62, 0xf0, 0xdb, 0x03, 0x28, 0x69, 0x24, 0x84, 0x47, 0x51, 0x7a, 0xc5, 0x5c, 0x8a,
+	0xeb, 0x5a, 0xa5, 0x0e, 0x25, 0x2e, 0x54, 0x21, 0x9c, 0xc2, 0x63, 0x85, 0x33, 0x19, 0x35, 0x28,
+	0x59, 0xa1, 0xdd, 0x32, 0xb8, 0x58, 0x45, 0xc9, 0x38, 0x1e, 0xb1, 0xe8, 0xae, 0x4a, 0x69, 0x65,
+	0x55, 0x5c, 0xa8, 0x42, 0x38, 0x82, 0x1d, 0x95, 0x5e, 0x57, 0x15, 0xbd, 0x6a, 0xd1, 0x5d, 0xeb,
+	0x2f, 0xa1, 0xc1, 0x05, 0x6c, 0x2f, 0x2e, 0x0e, 0x39, 0x80, 0xcd, 0x33, 0xae, 0x93, 0x98, 0xcd,
+	0x2f, 0x52, 0x05, 0xb2, 0x59, 0xaa, 0xae, 0x54, 0x20, 0x2a, 0x63, 0xbc, 0xa8, 0x08, 0xe4, 0xec,
+	0xe0, 0x13, 0x90, 0xea, 0xd2, 0xeb, 0x44, 0x0a, 0x8d, 0x0b, 0x92, 0x7a, 0xb5, 0x5b, 0xf7, 0xa1,
+	0x9d, 0x30, 0xad, 0xef, 0xa5, 0xba, 0x71, 0xd9, 0x9c, 0x1d, 0x04, 0xb0, 0x75, 0x39, 0x4f, 0xb0,
+	0xc8, 0x43, 0x60, 0xd5, 0xcc, 0x13, 0x97, 0xc3, 0x9e, 0x83, 0x0d, 0x58, 0x7b, 0x3f, 0x49, 0xcc,
+	0x3c, 0x38, 0x86, 0xee, 0x17, 0x54, 0x9a, 0x4b, 0x51, 0xe0, 0xfb, 0xb0, 0x31, 0xcb, 0x5c, 0x39,
+	0xc5, 0x99, 0xc1, 0x47, 0xe8, 0x15, 0x1b, 0xad, 0xdd, 0xbe, 0xbc, 0x86, 0xb6, 0xca, 0x8e, 0xe9,
+	0x1d, 0xb6, 0xec, 0xfa, 0x15, 0xdb, 0x52, 0x7f, 0x00, 0xb4, 0xc0, 0x06, 0xcf, 0x81, 0x54, 0x93,
+	0xe5, 0xc5, 0xf7, 0x60, 0x1d, 0x95, 0x92, 0x2a, 0xcb, 0xd5, 0xa1, 0xb9, 0x75, 0xf2, 0xa7, 0x05,
+	0xed, 0xb3, 0xfc, 0xc3, 0x22, 0x21, 0xac, 0xa6, 0x13, 0x92, 0x6e, 0x59, 0xc8, 0x4e, 0xe3, 0xef,
+	0x95, 0x8e, 0x05, 0x09, 0xce, 0x01, 0x4a, 0x81, 0xc9, 0xd3, 0x12, 0xd5, 0xf8, 0x6b, 0xfc, 0xfd,
+	0xe5, 0xc1, 0x3c, 0xd1, 0x1b, 0xe8, 0x14, 0x4d, 0x93, 0x7f, 0xcc, 0xe9, 0xd7, 0x5b, 0x4b, 0xdf,
+	0x69, 0xf9, 0xd6, 0xaa, 0x2d, 0x34, 0x5e, 0xe0, 0x52, 0x6e, 0xf9, 0xdf, 0x56, 0xb9, 0x8d, 0x5f,
+	0xb8, 0xc9, 0x3d, 0x82, 0xb5, 0x61, 0x2c, 0xf5, 0x12, 0xb1, 0x1a, 0xd0, 0x57, 0xb0, 0x91, 0xef,
+	0x42, 0x13, 0xfc, 0xa4, 0x74, 0xd4, 0xf7, 0xe5, 0x1c, 0xa0, 0x18, 0x5f, 0x2f, 0x4e, 0x56, 0xdb,
+	0x15, 0x7f, 0x7f, 0x79, 0x30, 0x4b, 0x34, 0x5a, 0xb7, 0xdf, 0xd5, 0xe9, 0xdf, 0x01, 0x00, 0x38,
+	0x9d, 0x4c, 0xe2, 0xbc, 0x06, 0x00, 0x00,
 }
@@ -1,10 +1,23 @@
 package dbplugin
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	metrics "github.com/armon/go-metrics"
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/strutil"
 	log "github.com/mgutz/logxi/v1"
 )
 
@@ -18,6 +31,32 @@ type databaseTracingMiddleware struct {
 
 	typeStr   string
 	transport string
+	version   string
+}
+
+// trace logs a trace line, adding the version of the plugin when known
+func (mw *databaseTracingMiddleware) trace(msg string, args ...interface{}) {
+	if mw.version != "" {
+		args = append(args, "version", mw.version)
+	}
+	mw.logger.Trace(msg, args...)
+}
+
+// transportFields returns the transport of the operation and whether its
+// connection was mutually authenticated, as recorded in the context by the
+// plugin RPC client. Without such a record the static transport of the
+// middleware is used and the authentication is unknown.
+func (mw *databaseTracingMiddleware) transportFields(ctx context.Context) (string, string) {
+	info, ok := TransportInfoFromContext(ctx)
+	if !ok {
+		return mw.transport, "unknown"
+	}
+
+	transport := info.Transport
+	if transport == "" {
+		transport = mw.transport
+	}
+	return transport, strconv.FormatBool(info.MutualTLS)
 }
 
 func (mw *databaseTracingMiddleware) Type() (string, error) {
@@ -25,47 +64,81 @@ func (mw *databaseTracingMiddleware) Type() (string, error) {
 }
 
 func (mw *databaseTracingMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	ctx = contextWithTransportInfoRecorder(ctx)
+	transport, mutualTLS := mw.transportFields(ctx)
 	defer func(then time.Time) {
-		mw.logger.Trace("database", "operation", "CreateUser", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "err", err, "took", time.Since(then))
+		// The plugin RPC client records the transport while performing
+		// the operation
+		transport, mutualTLS := mw.transportFields(ctx)
+		mw.trace("database", "operation", "CreateUser", "status", "finished", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "err", err, "took", time.Since(then))
 	}(time.Now())
 
-	mw.logger.Trace("database", "operation", "CreateUser", "status", "started", "type", mw.typeStr, "transport", mw.transport)
+	mw.trace("database", "operation", "CreateUser", "status", "started", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS)
 	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
 }
 
 func (mw *databaseTracingMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) (err error) {
+	ctx = contextWithTransportInfoRecorder(ctx)
+	transport, mutualTLS := mw.transportFields(ctx)
 	defer func(then time.Time) {
-		mw.logger.Trace("database", "operation", "RenewUser", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "err", err, "took", time.Since(then))
+		// The plugin RPC client records the transport while performing
+		// the operation
+		transport, mutualTLS := mw.transportFields(ctx)
+		mw.trace("database", "operation", "RenewUser", "status", "finished", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "err", err, "took", time.Since(then))
 	}(time.Now())
 
-	mw.logger.Trace("database", "operation", "RenewUser", "status", "started", mw.typeStr, "transport", mw.transport)
+	mw.trace("database", "operation", "RenewUser", "status", "started", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS)
 	return mw.next.RenewUser(ctx, statements, username, expiration)
 }
 
+func (mw *databaseTracingMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) (errs []error) {
+	ctx = contextWithTransportInfoRecorder(ctx)
+	transport, mutualTLS := mw.transportFields(ctx)
+	defer func(then time.Time) {
+		// The plugin RPC client records the transport while performing
+		// the operation
+		transport, mutualTLS := mw.transportFields(ctx)
+		mw.trace("database", "operation", "RenewUsers", "status", "finished", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "count", len(requests), "failed", countErrors(errs), "took", time.Since(then))
+	}(time.Now())
+
+	mw.trace("database", "operation", "RenewUsers", "status", "started", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "count", len(requests))
+	return RenewUsers(ctx, mw.next, requests)
+}
+
 func (mw *databaseTracingMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) (err error) {
+	ctx = contextWithTransportInfoRecorder(ctx)
+	transport, mutualTLS := mw.transportFields(ctx)
 	defer func(then time.Time) {
-		mw.logger.Trace("database", "operation", "RevokeUser", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "err", err, "took", time.Since(then))
+		// The plugin RPC client records the transport while performing
+		// the operation
+		transport, mutualTLS := mw.transportFields(ctx)
+		mw.trace("database", "operation", "RevokeUser", "status", "finished", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "err", err, "took", time.Since(then))
 	}(time.Now())
 
-	mw.logger.Trace("database", "operation", "RevokeUser", "status", "started", "type", mw.typeStr, "transport", mw.transport)
+	mw.trace("database", "operation", "RevokeUser", "status", "started", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS)
 	return mw.next.RevokeUser(ctx, statements, username)
 }
 
 func (mw *databaseTracingMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) (err error) {
+	ctx = contextWithTransportInfoRecorder(ctx)
+	transport, mutualTLS := mw.transportFields(ctx)
 	defer func(then time.Time) {
-		mw.logger.Trace("database", "operation", "Initialize", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "verify", verifyConnection, "err", err, "took", time.Since(then))
+		// The plugin RPC client records the transport while performing
+		// the operation
+		transport, mutualTLS := mw.transportFields(ctx)
+		mw.trace("database", "operation", "Initialize", "status", "finished", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS, "verify", verifyConnection, "err", err, "took", time.Since(then))
 	}(time.Now())
 
-	mw.logger.Trace("database", "operation", "Initialize", "status", "started", "type", mw.typeStr, "transport", mw.transport)
+	mw.trace("database", "operation", "Initialize", "status", "started", "type", mw.typeStr, "transport", transport, "mutual_tls", mutualTLS)
 	return mw.next.Initialize(ctx, conf, verifyConnection)
 }
 
 func (mw *databaseTracingMiddleware) Close() (err error) {
 	defer func(then time.Time) {
-		mw.logger.Trace("database", "operation", "Close", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "err", err, "took", time.Since(then))
+		mw.trace("database", "operation", "Close", "status", "finished", "type", mw.typeStr, "transport", mw.transport, "mutual_tls", "unknown", "err", err, "took", time.Since(then))
 	}(time.Now())
 
-	mw.logger.Trace("database", "operation", "Close", "status", "started", "type", mw.typeStr, "transport", mw.transport)
+	mw.trace("database", "operation", "Close", "status", "started", "type", mw.typeStr, "transport", mw.transport, "mutual_tls", "unknown")
 	return mw.next.Close()
 }
 
@@ -79,35 +152,62 @@ type databaseMetricsMiddleware struct {
 	typeStr string
 }
 
+// metricsStatus returns the key suffix under which the latency of a call is
+// recorded, so that fast failures and slow timeouts don't skew the latency
+// distribution of successful calls.
+func metricsStatus(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// countErrors returns the number of non-nil errors
+func countErrors(errs []error) int {
+	var n int
+	for _, err := range errs {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// roleLabels returns the labels identifying the role an operation is
+// performed for, or nil if the context doesn't carry a role name.
+func roleLabels(ctx context.Context) []metrics.Label {
+	roleName, ok := RoleNameFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return []metrics.Label{{Name: "role", Value: roleName}}
+}
+
 func (mw *databaseMetricsMiddleware) Type() (string, error) {
 	return mw.next.Type()
 }
 
 func (mw *databaseMetricsMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	labels := roleLabels(ctx)
 	defer func(now time.Time) {
-		metrics.MeasureSince([]string{"database", "CreateUser"}, now)
-		metrics.MeasureSince([]string{"database", mw.typeStr, "CreateUser"}, now)
+		status := metricsStatus(err)
+		metrics.MeasureSince([]string{"database", "CreateUser", status}, now)
+		metrics.MeasureSince([]string{"database", mw.typeStr, "CreateUser", status}, now)
 
 		if err != nil {
 			metrics.IncrCounter([]string{"database", "CreateUser", "error"}, 1)
-			metrics.IncrCounter([]string{"database", mw.typeStr, "CreateUser", "error"}, 1)
+			metrics.IncrCounterWithLabels([]string{"database", mw.typeStr, "CreateUser", "error"}, 1, labels)
 		}
 	}(time.Now())
 
 	metrics.IncrCounter([]string{"database", "CreateUser"}, 1)
-	metrics.IncrCounter([]string{"database", mw.typeStr, "CreateUser"}, 1)
+	metrics.IncrCounterWithLabels([]string{"database", mw.typeStr, "CreateUser"}, 1, labels)
 	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
 }
 
 func (mw *databaseMetricsMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) (err error) {
 	defer func(now time.Time) {
-		metrics.MeasureSince([]string{"database", "RenewUser"}, now)
-		metrics.MeasureSince([]string{"database", mw.typeStr, "RenewUser"}, now)
-
-		if err != nil {
-			metrics.IncrCounter([]string{"database", "RenewUser", "error"}, 1)
-			metrics.IncrCounter([]string{"database", mw.typeStr, "RenewUser", "error"}, 1)
-		}
+		mw.measureRenewal(now, err)
 	}(time.Now())
 
 	metrics.IncrCounter([]string{"database", "RenewUser"}, 1)
@@ -115,26 +215,78 @@ func (mw *databaseMetricsMiddleware) RenewUser(ctx context.Context, statements S
 	return mw.next.RenewUser(ctx, statements, username, expiration)
 }
 
+// measureRenewal records the latency and the outcome of a renewal started at
+// now
+func (mw *databaseMetricsMiddleware) measureRenewal(now time.Time, err error) {
+	// Renewals come in storms around lease expiry; the timers are samples,
+	// so the one per type exposes the tail of their latency
+	status := metricsStatus(err)
+	metrics.MeasureSince([]string{"database", "RenewUser", status}, now)
+	metrics.MeasureSince([]string{"database", mw.typeStr, "RenewUser", status}, now)
+
+	if err != nil {
+		metrics.IncrCounter([]string{"database", "RenewUser", "error"}, 1)
+		metrics.IncrCounter([]string{"database", mw.typeStr, "RenewUser", "error"}, 1)
+	}
+}
+
+// RenewUsers records each request of the batch as a renewal, whose latency
+// is that of the whole batch. If the wrapped Database can't renew users in
+// batches, the requests go through RenewUser so that each one is measured
+// on its own.
+func (mw *databaseMetricsMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) (errs []error) {
+	if _, ok := mw.next.(BatchRenewer); !ok {
+		errs = make([]error, len(requests))
+		for i, req := range requests {
+			errs[i] = mw.RenewUser(ctx, req.Statements, req.Username, req.Expiration)
+		}
+		return errs
+	}
+
+	defer func(now time.Time) {
+		// A batch with any failed renewal is recorded as an error
+		status := "success"
+		if countErrors(errs) != 0 {
+			status = "error"
+		}
+		metrics.MeasureSince([]string{"database", "RenewUsers", status}, now)
+		metrics.MeasureSince([]string{"database", mw.typeStr, "RenewUsers", status}, now)
+
+		for _, err := range errs {
+			mw.measureRenewal(now, err)
+		}
+	}(time.Now())
+
+	metrics.IncrCounter([]string{"database", "RenewUsers"}, 1)
+	metrics.IncrCounter([]string{"database", mw.typeStr, "RenewUsers"}, 1)
+	metrics.IncrCounter([]string{"database", "RenewUser"}, float32(len(requests)))
+	metrics.IncrCounter([]string{"database", mw.typeStr, "RenewUser"}, float32(len(requests)))
+	return RenewUsers(ctx, mw.next, requests)
+}
+
 func (mw *databaseMetricsMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) (err error) {
+	labels := roleLabels(ctx)
 	defer func(now time.Time) {
-		metrics.MeasureSince([]string{"database", "RevokeUser"}, now)
-		metrics.MeasureSince([]string{"database", mw.typeStr, "RevokeUser"}, now)
+		status := metricsStatus(err)
+		metrics.MeasureSince([]string{"database", "RevokeUser", status}, now)
+		metrics.MeasureSince([]string{"database", mw.typeStr, "RevokeUser", status}, now)
 
 		if err != nil {
 			metrics.IncrCounter([]string{"database", "RevokeUser", "error"}, 1)
-			metrics.IncrCounter([]string{"database", mw.typeStr, "RevokeUser", "error"}, 1)
+			metrics.IncrCounterWithLabels([]string{"database", mw.typeStr, "RevokeUser", "error"}, 1, labels)
 		}
 	}(time.Now())
 
 	metrics.IncrCounter([]string{"database", "RevokeUser"}, 1)
-	metrics.IncrCounter([]string{"database", mw.typeStr, "RevokeUser"}, 1)
+	metrics.IncrCounterWithLabels([]string{"database", mw.typeStr, "RevokeUser"}, 1, labels)
 	return mw.next.RevokeUser(ctx, statements, username)
 }
 
 func (mw *databaseMetricsMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) (err error) {
 	defer func(now time.Time) {
-		metrics.MeasureSince([]string{"database", "Initialize"}, now)
-		metrics.MeasureSince([]string{"database", mw.typeStr, "Initialize"}, now)
+		status := metricsStatus(err)
+		metrics.MeasureSince([]string{"database", "Initialize", status}, now)
+		metrics.MeasureSince([]string{"database", mw.typeStr, "Initialize", status}, now)
 
 		if err != nil {
 			metrics.IncrCounter([]string{"database", "Initialize", "error"}, 1)
@@ -149,8 +301,9 @@ func (mw *databaseMetricsMiddleware) Initialize(ctx context.Context, conf map[st
 
 func (mw *databaseMetricsMiddleware) Close() (err error) {
 	defer func(now time.Time) {
-		metrics.MeasureSince([]string{"database", "Close"}, now)
-		metrics.MeasureSince([]string{"database", mw.typeStr, "Close"}, now)
+		status := metricsStatus(err)
+		metrics.MeasureSince([]string{"database", "Close", status}, now)
+		metrics.MeasureSince([]string{"database", mw.typeStr, "Close", status}, now)
 
 		if err != nil {
 			metrics.IncrCounter([]string{"database", "Close", "error"}, 1)
@@ -162,3 +315,1388 @@ func (mw *databaseMetricsMiddleware) Close() (err error) {
 	metrics.IncrCounter([]string{"database", mw.typeStr, "Close"}, 1)
 	return mw.next.Close()
 }
+
+// ---- Error Sanitizer Middleware Domain ----
+
+// redactedValue replaces secret values in sanitized errors
+const redactedValue = "[REDACTED]"
+
+// urlUserInfoRe matches the user info portion of URLs
+var urlUserInfoRe = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// redactSecrets returns msg with every occurrence of the given secrets, as
+// well as the user info of any URL it contains, replaced by redactedValue.
+func redactSecrets(msg string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		msg = strings.Replace(msg, secret, redactedValue, -1)
+	}
+
+	return urlUserInfoRe.ReplaceAllString(msg, "${1}"+redactedValue+"@")
+}
+
+// connectionSecretRe matches the names of the connection settings holding
+// secret values
+var connectionSecretRe = regexp.MustCompile(`(?i)password|secret|private_key|pem`)
+
+// dsnPasswordRe matches the password of connection strings of the
+// user:password@host form, which lack a URL scheme
+var dsnPasswordRe = regexp.MustCompile(`^[^:@/\s]*:([^@/\s]+)@`)
+
+// connectionSecrets returns the secret values of the given connection
+// configuration: the string settings whose name denotes a secret, and the
+// password of the connection strings of the user:password@host form.
+func connectionSecrets(conf map[string]interface{}) []string {
+	var secrets []string
+	for k, v := range conf {
+		value, ok := v.(string)
+		if !ok || value == "" {
+			continue
+		}
+
+		if connectionSecretRe.MatchString(k) {
+			secrets = append(secrets, value)
+			continue
+		}
+
+		if m := dsnPasswordRe.FindStringSubmatch(value); m != nil {
+			secrets = append(secrets, m[1])
+		}
+	}
+	return secrets
+}
+
+// databaseErrorSanitizerMiddleware wraps an implementation of Database and
+// redacts known secret values, along with the credentials of connection URLs,
+// from the errors it returns. Only the secrets are masked; the rest of the
+// error, such as the database's error code, is kept intact. The secrets of the
+// connection configuration are picked up when Initialize is called.
+type databaseErrorSanitizerMiddleware struct {
+	next Database
+
+	// secretsFn returns additional secret values which must never appear in
+	// errors.
+	secretsFn func() []string
+
+	l sync.RWMutex
+
+	// connSecrets holds the secret values of the connection configuration
+	// the database was last initialized with
+	connSecrets []string
+}
+
+func (mw *databaseErrorSanitizerMiddleware) Type() (string, error) {
+	t, err := mw.next.Type()
+	return t, mw.sanitize(err)
+}
+
+func (mw *databaseErrorSanitizerMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+
+	// Some databases embed the generated password in the error returned
+	// when the user was only partially set up
+	return username, password, mw.sanitize(err, password)
+}
+
+func (mw *databaseErrorSanitizerMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.sanitize(mw.next.RenewUser(ctx, statements, username, expiration))
+}
+
+func (mw *databaseErrorSanitizerMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	errs := RenewUsers(ctx, mw.next, requests)
+	for i, err := range errs {
+		errs[i] = mw.sanitize(err)
+	}
+	return errs
+}
+
+func (mw *databaseErrorSanitizerMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	return mw.sanitize(mw.next.RevokeUser(ctx, statements, username))
+}
+
+func (mw *databaseErrorSanitizerMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	mw.l.Lock()
+	mw.connSecrets = connectionSecrets(conf)
+	mw.l.Unlock()
+
+	return mw.sanitize(mw.next.Initialize(ctx, conf, verifyConnection))
+}
+
+func (mw *databaseErrorSanitizerMiddleware) Close() error {
+	return mw.sanitize(mw.next.Close())
+}
+
+// sanitize redacts the secrets, along with the given extra secrets, from the
+// given error, leaving the rest of its message untouched.
+func (mw *databaseErrorSanitizerMiddleware) sanitize(err error, extraSecrets ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	sanitized := redactSecrets(msg, append(extraSecrets, mw.secrets()...))
+	if sanitized == msg {
+		return err
+	}
+
+	return errors.New(sanitized)
+}
+
+// secrets returns the secret values to redact from errors
+func (mw *databaseErrorSanitizerMiddleware) secrets() []string {
+	mw.l.RLock()
+	secrets := append([]string(nil), mw.connSecrets...)
+	mw.l.RUnlock()
+
+	if mw.secretsFn != nil {
+		secrets = append(secrets, mw.secretsFn()...)
+	}
+	return secrets
+}
+
+// ---- Error Translator Middleware Domain ----
+
+// errorTranslation maps the errors matching Pattern to a message an operator
+// can act upon
+type errorTranslation struct {
+	Pattern *regexp.Regexp
+	Message string
+}
+
+// defaultErrorTranslations holds translations for common, cryptic errors
+// returned by the database drivers
+var defaultErrorTranslations = []errorTranslation{
+	{
+		Pattern: regexp.MustCompile(`SQLSTATE 42710|role "[^"]*" already exists`),
+		Message: "the user already exists in the database; check that the username template generates unique names",
+	},
+	{
+		Pattern: regexp.MustCompile(`SQLSTATE 28P01|Error 1045`),
+		Message: "the database rejected the configured credentials; check the connection username and password",
+	},
+	{
+		Pattern: regexp.MustCompile(`SQLSTATE 42501|Error 1227|permission denied`),
+		Message: "the configured database user lacks the privileges required by the statements",
+	},
+	{
+		Pattern: regexp.MustCompile(`SQLSTATE 42601|Error 1064`),
+		Message: "the database rejected a statement due to a syntax error; check the role's statements",
+	},
+}
+
+// databaseErrorTranslatorMiddleware wraps an implementation of Database and
+// prefixes the errors it returns that match a known pattern with a friendlier
+// message. The original error is kept as the cause, and unknown errors are
+// passed through untouched. It is meant to be wrapped by the error sanitizer
+// so that secrets are still redacted from the translated errors.
+type databaseErrorTranslatorMiddleware struct {
+	next Database
+
+	// translations are evaluated in order; the first match wins
+	translations []errorTranslation
+}
+
+func (mw *databaseErrorTranslatorMiddleware) Type() (string, error) {
+	t, err := mw.next.Type()
+	return t, mw.translate(err)
+}
+
+func (mw *databaseErrorTranslatorMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+	return username, password, mw.translate(err)
+}
+
+func (mw *databaseErrorTranslatorMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.translate(mw.next.RenewUser(ctx, statements, username, expiration))
+}
+
+func (mw *databaseErrorTranslatorMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	errs := RenewUsers(ctx, mw.next, requests)
+	for i, err := range errs {
+		errs[i] = mw.translate(err)
+	}
+	return errs
+}
+
+func (mw *databaseErrorTranslatorMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	return mw.translate(mw.next.RevokeUser(ctx, statements, username))
+}
+
+func (mw *databaseErrorTranslatorMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.translate(mw.next.Initialize(ctx, conf, verifyConnection))
+}
+
+func (mw *databaseErrorTranslatorMiddleware) Close() error {
+	return mw.translate(mw.next.Close())
+}
+
+// translate returns the error prefixed with the message of the first
+// translation matching it, or the error itself if none match.
+func (mw *databaseErrorTranslatorMiddleware) translate(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	for _, t := range mw.translations {
+		if t.Pattern.MatchString(msg) {
+			return errwrap.Wrapf(t.Message+": {{err}}", err)
+		}
+	}
+
+	return err
+}
+
+// ---- Replica Middleware Domain ----
+
+// databaseReplicaMiddleware dispatches calls across a primary Database and a
+// set of replicas of it. Read-only operations are sent to the replicas in a
+// round-robin fashion, failing over to the primary if all the replicas
+// error, while operations that mutate the database are only ever sent to the
+// primary. Initialize and Close apply to all of them.
+type databaseReplicaMiddleware struct {
+	primary  Database
+	replicas []Database
+
+	// connectionURLs holds the connection URL of each replica, which
+	// replaces the connection_url setting of the configuration the replica
+	// is initialized with. Replicas without one are initialized with the
+	// configuration of the primary as is.
+	connectionURLs []string
+
+	// counter is used to select the replica serving the next read
+	counter uint32
+}
+
+func (mw *databaseReplicaMiddleware) Type() (string, error) {
+	if n := len(mw.replicas); n > 0 {
+		start := int(atomic.AddUint32(&mw.counter, 1))
+		for i := 0; i < n; i++ {
+			typeStr, err := mw.replicas[(start+i)%n].Type()
+			if err == nil {
+				return typeStr, nil
+			}
+		}
+	}
+
+	return mw.primary.Type()
+}
+
+func (mw *databaseReplicaMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	return mw.primary.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databaseReplicaMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.primary.RenewUser(ctx, statements, username, expiration)
+}
+
+func (mw *databaseReplicaMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, mw.primary, requests)
+}
+
+func (mw *databaseReplicaMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	return mw.primary.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databaseReplicaMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	err := mw.primary.Initialize(ctx, conf, verifyConnection)
+	if err != nil {
+		return err
+	}
+
+	var retErr *multierror.Error
+	for i, replica := range mw.replicas {
+		if err := replica.Initialize(ctx, mw.replicaConf(i, conf), verifyConnection); err != nil {
+			retErr = multierror.Append(retErr, errwrap.Wrapf(fmt.Sprintf("failed to initialize replica %d: {{err}}", i), err))
+		}
+	}
+
+	return retErr.ErrorOrNil()
+}
+
+// replicaConf returns the configuration the i-th replica is initialized with,
+// given the configuration of the primary
+func (mw *databaseReplicaMiddleware) replicaConf(i int, conf map[string]interface{}) map[string]interface{} {
+	if i >= len(mw.connectionURLs) {
+		return conf
+	}
+
+	replicaConf := make(map[string]interface{}, len(conf))
+	for k, v := range conf {
+		replicaConf[k] = v
+	}
+	replicaConf["connection_url"] = mw.connectionURLs[i]
+	return replicaConf
+}
+
+func (mw *databaseReplicaMiddleware) Close() error {
+	var retErr *multierror.Error
+	if err := mw.primary.Close(); err != nil {
+		retErr = multierror.Append(retErr, err)
+	}
+
+	for i, replica := range mw.replicas {
+		if err := replica.Close(); err != nil {
+			retErr = multierror.Append(retErr, errwrap.Wrapf(fmt.Sprintf("failed to close replica %d: {{err}}", i), err))
+		}
+	}
+
+	return retErr.ErrorOrNil()
+}
+
+// ---- Concurrency Limit Middleware Domain ----
+
+// ErrConcurrencyLimitReached is returned when an operation is rejected because
+// the maximum number of concurrent operations against a database is reached
+var ErrConcurrencyLimitReached = errors.New("maximum number of concurrent database operations reached")
+
+// databaseConcurrencyLimitMiddleware wraps an implementation of Database and
+// bounds the number of operations running concurrently against it, to avoid
+// oversubscribing its connection pool. When the limit is reached, operations
+// either wait for a slot to free up, giving up if their context is done, or
+// fail immediately with ErrConcurrencyLimitReached.
+type databaseConcurrencyLimitMiddleware struct {
+	next Database
+
+	sem      chan struct{}
+	failFast bool
+}
+
+func newDatabaseConcurrencyLimitMiddleware(next Database, limit int, failFast bool) *databaseConcurrencyLimitMiddleware {
+	return &databaseConcurrencyLimitMiddleware{
+		next:     next,
+		sem:      make(chan struct{}, limit),
+		failFast: failFast,
+	}
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) acquire(ctx context.Context) error {
+	if mw.failFast {
+		select {
+		case mw.sem <- struct{}{}:
+			return nil
+		default:
+			return ErrConcurrencyLimitReached
+		}
+	}
+
+	select {
+	case mw.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) release() {
+	<-mw.sem
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	if err := mw.acquire(ctx); err != nil {
+		return "", "", err
+	}
+	defer mw.release()
+
+	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	if err := mw.acquire(ctx); err != nil {
+		return err
+	}
+	defer mw.release()
+
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+// RenewUsers takes a single slot for the whole batch, which is sent to the
+// database as one operation
+func (mw *databaseConcurrencyLimitMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	if err := mw.acquire(ctx); err != nil {
+		return repeatError(err, len(requests))
+	}
+	defer mw.release()
+
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	if err := mw.acquire(ctx); err != nil {
+		return err
+	}
+	defer mw.release()
+
+	return mw.next.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	if err := mw.acquire(ctx); err != nil {
+		return err
+	}
+	defer mw.release()
+
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseConcurrencyLimitMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Orphan Sweeper Domain ----
+
+// databaseOrphanSweeper revokes database users which Vault lost track of,
+// e.g. because their lease was lost. It isn't a middleware but orchestrates
+// RevokeUser calls over a Database, which is expected to be wrapped in the
+// usual middlewares so that the revocations are traced and measured.
+type databaseOrphanSweeper struct {
+	db Database
+
+	// concurrency is the maximum number of revocations in flight; defaults
+	// to 1
+	concurrency int
+}
+
+// Sweep revokes the given users using the given statements. It returns the
+// error of each user which couldn't be revoked, by username. Users not yet
+// revoked when the context is done aren't attempted, and are reported with
+// the context's error.
+func (s *databaseOrphanSweeper) Sweep(ctx context.Context, statements Statements, usernames []string) map[string]error {
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var l sync.Mutex
+	failed := make(map[string]error)
+	fail := func(username string, err error) {
+		l.Lock()
+		defer l.Unlock()
+		failed[username] = err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, username := range usernames {
+		if err := ctx.Err(); err != nil {
+			fail(username, err)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			fail(username, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := s.db.RevokeUser(ctx, statements, username); err != nil {
+				fail(username, err)
+			}
+		}(username)
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// SweepOrphans revokes the given users, which Vault lost track of, using the
+// given statements and running at most concurrency revocations at a time. It
+// returns the error of each user which couldn't be revoked, by username.
+func SweepOrphans(ctx context.Context, db Database, statements Statements, usernames []string, concurrency int) map[string]error {
+	sweeper := &databaseOrphanSweeper{
+		db:          db,
+		concurrency: concurrency,
+	}
+	return sweeper.Sweep(ctx, statements, usernames)
+}
+
+// ---- Statement Error Middleware Domain ----
+
+// StatementError is implemented by the errors databases return when one of
+// the statements they were given failed.
+type StatementError interface {
+	error
+
+	// StatementIndex returns the zero-based position of the failed
+	// statement, among the statements parsed from the Statements field
+	// used by the operation
+	StatementIndex() int
+}
+
+// databaseStatementErrorMiddleware wraps an implementation of Database and
+// enriches the StatementErrors it returns with the position and the text of
+// the statement which failed, to help operators debug their roles.
+type databaseStatementErrorMiddleware struct {
+	next Database
+}
+
+func (mw *databaseStatementErrorMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseStatementErrorMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+	return username, password, enrichStatementError("creation", statements.CreationStatements, err)
+}
+
+func (mw *databaseStatementErrorMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	err := mw.next.RenewUser(ctx, statements, username, expiration)
+	return enrichStatementError("renew", statements.RenewStatements, err)
+}
+
+func (mw *databaseStatementErrorMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	errs := RenewUsers(ctx, mw.next, requests)
+	for i, err := range errs {
+		errs[i] = enrichStatementError("renew", requests[i].Statements.RenewStatements, err)
+	}
+	return errs
+}
+
+func (mw *databaseStatementErrorMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	err := mw.next.RevokeUser(ctx, statements, username)
+	return enrichStatementError("revocation", statements.RevocationStatements, err)
+}
+
+func (mw *databaseStatementErrorMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseStatementErrorMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// enrichStatementError prefixes err, if it is a StatementError, with the
+// position and the text of the failed statement among the given statements.
+// The statements are templates, so they don't hold the generated secrets.
+func enrichStatementError(kind, statements string, err error) error {
+	stmtErr, ok := err.(StatementError)
+	if !ok {
+		return err
+	}
+
+	parsed := strutil.ParseArbitraryStringSlice(statements, ";")
+	index := stmtErr.StatementIndex()
+	if index < 0 || index >= len(parsed) {
+		return errwrap.Wrapf(fmt.Sprintf("%s statement %d failed: {{err}}", kind, index+1), err)
+	}
+
+	return errwrap.Wrapf(fmt.Sprintf("%s statement %d (%q) failed: {{err}}", kind, index+1, strings.TrimSpace(parsed[index])), err)
+}
+
+// ---- Idempotent Revoke Middleware Domain ----
+
+// defaultIdempotentRevokeMaxEntries is the maximum number of revoked users
+// remembered by databaseIdempotentRevokeMiddleware if none is set
+const defaultIdempotentRevokeMaxEntries = 10000
+
+// revokedUser records when a user was revoked
+type revokedUser struct {
+	username  string
+	revokedAt time.Time
+}
+
+// databaseIdempotentRevokeMiddleware remembers the users it successfully
+// revoked for a while and reports later revocations of the same users as
+// successful without calling the plugin. Revocation can be triggered twice
+// for a user, and some plugins fail to revoke a user which doesn't exist.
+// Entries expire after ttl, and the oldest ones are dropped once maxEntries
+// of them are remembered, which bounds the memory used.
+type databaseIdempotentRevokeMiddleware struct {
+	next Database
+
+	ttl time.Duration
+	now func() time.Time
+
+	// maxEntries defaults to defaultIdempotentRevokeMaxEntries
+	maxEntries int
+
+	l       sync.Mutex
+	revoked map[string]time.Time
+
+	// order holds the revocations from the oldest to the newest, so that
+	// expired entries are dropped without scanning the whole map. It may
+	// hold entries which were since dropped from revoked, or superseded by
+	// a later revocation of the same user; these are skipped. Every entry
+	// of revoked is in order, so bounding order bounds both.
+	order *list.List
+}
+
+func newDatabaseIdempotentRevokeMiddleware(next Database, ttl time.Duration) *databaseIdempotentRevokeMiddleware {
+	return &databaseIdempotentRevokeMiddleware{
+		next:       next,
+		ttl:        ttl,
+		now:        time.Now,
+		maxEntries: defaultIdempotentRevokeMaxEntries,
+		revoked:    make(map[string]time.Time),
+		order:      list.New(),
+	}
+}
+
+// recentlyRevoked returns whether username was revoked less than ttl ago,
+// dropping its entry if it expired
+func (mw *databaseIdempotentRevokeMiddleware) recentlyRevoked(username string) bool {
+	mw.l.Lock()
+	defer mw.l.Unlock()
+
+	revokedAt, ok := mw.revoked[username]
+	if !ok {
+		return false
+	}
+	if mw.now().Sub(revokedAt) >= mw.ttl {
+		delete(mw.revoked, username)
+		return false
+	}
+	return true
+}
+
+// record remembers that username was just revoked, dropping the expired
+// entries and the oldest ones above maxEntries along the way
+func (mw *databaseIdempotentRevokeMiddleware) record(username string) {
+	mw.l.Lock()
+	defer mw.l.Unlock()
+
+	now := mw.now()
+	mw.revoked[username] = now
+	mw.order.PushBack(revokedUser{username: username, revokedAt: now})
+
+	for e := mw.order.Front(); e != nil; e = mw.order.Front() {
+		entry := e.Value.(revokedUser)
+		current, ok := mw.revoked[entry.username]
+		stale := !ok || !current.Equal(entry.revokedAt)
+		if !stale && now.Sub(entry.revokedAt) < mw.ttl && mw.order.Len() <= mw.maxEntries {
+			break
+		}
+
+		mw.order.Remove(e)
+		if !stale {
+			delete(mw.revoked, entry.username)
+		}
+	}
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+	if err == nil {
+		// A user created again under the same name must be revocable
+		mw.l.Lock()
+		delete(mw.revoked, username)
+		mw.l.Unlock()
+	}
+	return username, password, err
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	if mw.recentlyRevoked(username) {
+		return nil
+	}
+
+	if err := mw.next.RevokeUser(ctx, statements, username); err != nil {
+		return err
+	}
+
+	mw.record(username)
+	return nil
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseIdempotentRevokeMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Statement Size Middleware Domain ----
+
+// defaultMaxStatementSize is the maximum size of the statements accepted by
+// databaseStatementSizeMiddleware if none is set. It leaves room for the rest
+// of the request within the default 4MB message size limit of gRPC servers.
+const defaultMaxStatementSize = 4<<20 - 64<<10
+
+// databaseStatementSizeMiddleware rejects operations whose statements exceed
+// maxSize bytes once serialized, before they are sent to the plugin.
+// Oversized statements would otherwise exceed the message size limit of the
+// plugin RPC transport and fail with an obscure transport error.
+type databaseStatementSizeMiddleware struct {
+	next Database
+
+	// maxSize defaults to defaultMaxStatementSize
+	maxSize int
+}
+
+// checkSize returns an error naming the limit if the serialized statements
+// are larger than maxSize
+func (mw *databaseStatementSizeMiddleware) checkSize(statements Statements) error {
+	maxSize := mw.maxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxStatementSize
+	}
+
+	size := proto.Size(&statements)
+	if size > maxSize {
+		return fmt.Errorf("statements are %d bytes, exceeding the maximum of %d bytes", size, maxSize)
+	}
+	return nil
+}
+
+func (mw *databaseStatementSizeMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseStatementSizeMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	if err := mw.checkSize(statements); err != nil {
+		return "", "", err
+	}
+	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databaseStatementSizeMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	if err := mw.checkSize(statements); err != nil {
+		return err
+	}
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+// RenewUsers rejects the requests whose statements are too large and sends
+// the others to the wrapped Database
+func (mw *databaseStatementSizeMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	errs := make([]error, len(requests))
+	var valid []RenewRequest
+	var indexes []int
+	for i, req := range requests {
+		if err := mw.checkSize(req.Statements); err != nil {
+			errs[i] = err
+			continue
+		}
+		valid = append(valid, req)
+		indexes = append(indexes, i)
+	}
+
+	if len(valid) == 0 {
+		return errs
+	}
+
+	for i, err := range RenewUsers(ctx, mw.next, valid) {
+		errs[indexes[i]] = err
+	}
+	return errs
+}
+
+func (mw *databaseStatementSizeMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	if err := mw.checkSize(statements); err != nil {
+		return err
+	}
+	return mw.next.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databaseStatementSizeMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseStatementSizeMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Cancellation Middleware Domain ----
+
+// ErrOperationCancelled is returned by databaseCancellationMiddleware in
+// place of the error of an operation whose context was done
+var ErrOperationCancelled = errors.New("database operation cancelled")
+
+// databaseCancellationMiddleware normalizes the errors of operations whose
+// context is done, either before or during the call, to
+// ErrOperationCancelled. Plugins report cancellation in different ways,
+// e.g. context.Canceled, a wrapped error or a driver specific one, which
+// this hides from the callers. Operations whose context is already done
+// are not sent to the plugin.
+type databaseCancellationMiddleware struct {
+	next Database
+}
+
+// normalize returns ErrOperationCancelled if err is set and ctx is done
+func (mw *databaseCancellationMiddleware) normalize(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ErrOperationCancelled
+	}
+	return err
+}
+
+func (mw *databaseCancellationMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseCancellationMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	if ctx.Err() != nil {
+		return "", "", ErrOperationCancelled
+	}
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+	return username, password, mw.normalize(ctx, err)
+}
+
+func (mw *databaseCancellationMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	if ctx.Err() != nil {
+		return ErrOperationCancelled
+	}
+	return mw.normalize(ctx, mw.next.RenewUser(ctx, statements, username, expiration))
+}
+
+func (mw *databaseCancellationMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	if ctx.Err() != nil {
+		return repeatError(ErrOperationCancelled, len(requests))
+	}
+	errs := RenewUsers(ctx, mw.next, requests)
+	for i, err := range errs {
+		errs[i] = mw.normalize(ctx, err)
+	}
+	return errs
+}
+
+func (mw *databaseCancellationMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	if ctx.Err() != nil {
+		return ErrOperationCancelled
+	}
+	return mw.normalize(ctx, mw.next.RevokeUser(ctx, statements, username))
+}
+
+func (mw *databaseCancellationMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	if ctx.Err() != nil {
+		return ErrOperationCancelled
+	}
+	return mw.normalize(ctx, mw.next.Initialize(ctx, conf, verifyConnection))
+}
+
+func (mw *databaseCancellationMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Credential Limit Middleware Domain ----
+
+// ErrCredentialLimitReached is returned by databaseCredentialLimitMiddleware
+// when creating a user would exceed its limit of live credentials
+var ErrCredentialLimitReached = errors.New("maximum number of database credentials reached")
+
+// databaseCredentialLimitMiddleware tracks the users created and not yet
+// revoked through it, and fails further creations with
+// ErrCredentialLimitReached once limit of them are live. The limit only
+// covers the users created by this process since the middleware was set up:
+// users created before, e.g. before a reload or a restart, are neither
+// counted nor affect the count when revoked.
+type databaseCredentialLimitMiddleware struct {
+	next Database
+
+	limit int
+
+	l sync.Mutex
+
+	// users holds the live users created through the middleware
+	users map[string]struct{}
+
+	// reserved is the number of creations in flight
+	reserved int
+}
+
+// Count returns the number of live credentials
+func (mw *databaseCredentialLimitMiddleware) Count() int {
+	mw.l.Lock()
+	defer mw.l.Unlock()
+
+	return len(mw.users)
+}
+
+func (mw *databaseCredentialLimitMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseCredentialLimitMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	// Reserve a slot up front so that concurrent creations can't overshoot
+	// the limit
+	mw.l.Lock()
+	if len(mw.users)+mw.reserved >= mw.limit {
+		mw.l.Unlock()
+		return "", "", ErrCredentialLimitReached
+	}
+	mw.reserved++
+	mw.l.Unlock()
+
+	username, password, err = mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+
+	mw.l.Lock()
+	mw.reserved--
+	if err == nil {
+		if mw.users == nil {
+			mw.users = make(map[string]struct{})
+		}
+		mw.users[username] = struct{}{}
+	}
+	mw.l.Unlock()
+
+	return username, password, err
+}
+
+func (mw *databaseCredentialLimitMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+func (mw *databaseCredentialLimitMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databaseCredentialLimitMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	if err := mw.next.RevokeUser(ctx, statements, username); err != nil {
+		return err
+	}
+
+	mw.l.Lock()
+	delete(mw.users, username)
+	mw.l.Unlock()
+
+	return nil
+}
+
+func (mw *databaseCredentialLimitMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseCredentialLimitMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Panic Recovery Middleware Domain ----
+
+// databasePanicRecoveryMiddleware recovers from panics of the wrapped
+// Database and turns them into errors. The panic value and the stack trace
+// are logged once redacted like the errors of
+// databaseErrorSanitizerMiddleware, since both can hold connection strings
+// or passwords which were on the stack.
+type databasePanicRecoveryMiddleware struct {
+	next   Database
+	logger log.Logger
+
+	// secretsFn returns the secret values, such as the passwords from the
+	// connection configuration, which must never appear in the logs.
+	secretsFn func() []string
+}
+
+// recover must be deferred by each operation. It recovers from a panic of
+// the operation and sets err to an error describing it.
+func (mw *databasePanicRecoveryMiddleware) recover(operation string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	var secrets []string
+	if mw.secretsFn != nil {
+		secrets = mw.secretsFn()
+	}
+
+	msg := redactSecrets(fmt.Sprintf("%v", r), secrets)
+	stack := redactSecrets(string(debug.Stack()), secrets)
+	mw.logger.Error("database: recovered from plugin panic", "operation", operation, "panic", msg, "stack", stack)
+
+	*err = fmt.Errorf("database plugin panicked during %s: %s", operation, msg)
+}
+
+func (mw *databasePanicRecoveryMiddleware) Type() (t string, err error) {
+	defer mw.recover("Type", &err)
+	return mw.next.Type()
+}
+
+func (mw *databasePanicRecoveryMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	defer mw.recover("CreateUser", &err)
+	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databasePanicRecoveryMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) (err error) {
+	defer mw.recover("RenewUser", &err)
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+func (mw *databasePanicRecoveryMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) (errs []error) {
+	// A panic fails the whole batch
+	var err error
+	defer func() {
+		if err != nil {
+			errs = repeatError(err, len(requests))
+		}
+	}()
+	defer mw.recover("RenewUsers", &err)
+
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databasePanicRecoveryMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) (err error) {
+	defer mw.recover("RevokeUser", &err)
+	return mw.next.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databasePanicRecoveryMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) (err error) {
+	defer mw.recover("Initialize", &err)
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databasePanicRecoveryMiddleware) Close() (err error) {
+	defer mw.recover("Close", &err)
+	return mw.next.Close()
+}
+
+// ---- Lease Deadline Middleware Domain ----
+
+// defaultLeaseDeadlineMinTimeout is the minimum time given to CreateUser by
+// databaseLeaseDeadlineMiddleware if none is set
+const defaultLeaseDeadlineMinTimeout = 10 * time.Second
+
+// databaseLeaseDeadlineMiddleware bounds CreateUser by the expiration of the
+// credential being created, since a credential which can only be created
+// after it expired is useless. The deadline is never less than minTimeout
+// away, so that credentials with very short or past expirations still get a
+// chance to be created.
+type databaseLeaseDeadlineMiddleware struct {
+	next Database
+
+	// minTimeout defaults to defaultLeaseDeadlineMinTimeout
+	minTimeout time.Duration
+	now        func() time.Time
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	if expiration.IsZero() {
+		return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+	}
+
+	now := time.Now
+	if mw.now != nil {
+		now = mw.now
+	}
+
+	minTimeout := mw.minTimeout
+	if minTimeout <= 0 {
+		minTimeout = defaultLeaseDeadlineMinTimeout
+	}
+
+	deadline := expiration
+	if floor := now().Add(minTimeout); deadline.Before(floor) {
+		deadline = floor
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	return mw.next.RenewUser(ctx, statements, username, expiration)
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	return mw.next.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseLeaseDeadlineMiddleware) Close() error {
+	return mw.next.Close()
+}
+
+// ---- Renewal Batcher Middleware Domain ----
+
+// defaultRenewBatchMaxRequests is the maximum number of renewals sent in a
+// batch by databaseRenewBatcherMiddleware if none is set
+const defaultRenewBatchMaxRequests = 100
+
+// defaultRenewBatchMaxInFlight is the maximum number of renewals and batches
+// in flight at once in databaseRenewBatcherMiddleware if none is set
+const defaultRenewBatchMaxInFlight = 8
+
+// pendingRenewal is a renewal waiting to be sent in a batch
+type pendingRenewal struct {
+	ctx  context.Context
+	req  RenewRequest
+	done chan error
+
+	// batch is the batch the renewal was sent in, if any
+	batch *renewalBatch
+}
+
+// renewalBatch tracks the renewals of a batch still waiting for it, so that
+// it is cancelled once none are
+type renewalBatch struct {
+	waiting int
+	cancel  context.CancelFunc
+}
+
+// valuesContext holds the values of a context without its deadline and
+// cancellation
+type valuesContext struct {
+	context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valuesContext) Done() <-chan struct{}       { return nil }
+func (valuesContext) Err() error                  { return nil }
+
+// databaseRenewBatcherMiddleware bounds the renewals in flight against the
+// wrapped Database to maxInFlight, and sends the renewals requested while
+// the bound is reached together, in a single RenewUsers call. This saves
+// round trips to plugins renewing users in batches when many leases are
+// renewed at once. A batch carries the values of the context of its first
+// renewal, is bound by the latest deadline of its renewals, if all of them
+// have one, and is cancelled once all of them stopped waiting for it.
+type databaseRenewBatcherMiddleware struct {
+	next Database
+
+	// maxRequests defaults to defaultRenewBatchMaxRequests
+	maxRequests int
+
+	// maxSize bounds the size of the statements of a batch, which always
+	// holds at least one request; defaults to defaultMaxStatementSize
+	maxSize int
+
+	// maxInFlight defaults to defaultRenewBatchMaxInFlight
+	maxInFlight int
+
+	// supported, if set, reports whether the wrapped Database still renews
+	// users in batches. Once it doesn't, renewals are passed through.
+	supported func() bool
+
+	// panicRecovery, if set, recovers from the panics of the batches, which
+	// are sent from their own goroutines and fail every renewal waiting for
+	// them
+	panicRecovery *databasePanicRecoveryMiddleware
+
+	l        sync.Mutex
+	pending  []*pendingRenewal
+	inFlight int
+}
+
+func (mw *databaseRenewBatcherMiddleware) Type() (string, error) {
+	return mw.next.Type()
+}
+
+func (mw *databaseRenewBatcherMiddleware) CreateUser(ctx context.Context, statements Statements, usernameConfig UsernameConfig, expiration time.Time) (username string, password string, err error) {
+	return mw.next.CreateUser(ctx, statements, usernameConfig, expiration)
+}
+
+func (mw *databaseRenewBatcherMiddleware) RenewUser(ctx context.Context, statements Statements, username string, expiration time.Time) error {
+	if mw.supported != nil && !mw.supported() {
+		return mw.next.RenewUser(ctx, statements, username, expiration)
+	}
+
+	maxInFlight := mw.maxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = defaultRenewBatchMaxInFlight
+	}
+
+	mw.l.Lock()
+	if mw.inFlight < maxInFlight {
+		mw.inFlight++
+		mw.l.Unlock()
+
+		defer mw.release()
+		return mw.next.RenewUser(ctx, statements, username, expiration)
+	}
+
+	p := &pendingRenewal{
+		ctx: ctx,
+		req: RenewRequest{
+			Statements: statements,
+			Username:   username,
+			Expiration: expiration,
+		},
+		done: make(chan error, 1),
+	}
+	mw.pending = append(mw.pending, p)
+	mw.l.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		// The renewal may have completed as the context was done
+		select {
+		case err := <-p.done:
+			return err
+		default:
+		}
+
+		mw.abandon(p)
+		return ErrOperationCancelled
+	}
+}
+
+// abandon stops p from waiting for its renewal: it is dropped if not sent
+// yet, and its batch is cancelled if no other renewal waits for it
+func (mw *databaseRenewBatcherMiddleware) abandon(p *pendingRenewal) {
+	mw.l.Lock()
+	defer mw.l.Unlock()
+
+	if p.batch == nil {
+		for i, pending := range mw.pending {
+			if pending == p {
+				mw.pending = append(mw.pending[:i:i], mw.pending[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	p.batch.waiting--
+	if p.batch.waiting == 0 {
+		p.batch.cancel()
+	}
+}
+
+// release is called once a renewal or a batch is done. It hands its slot
+// over to the next batch of pending renewals, if any.
+func (mw *databaseRenewBatcherMiddleware) release() {
+	mw.l.Lock()
+	defer mw.l.Unlock()
+
+	if len(mw.pending) == 0 {
+		mw.inFlight--
+		return
+	}
+
+	batch, ctx, cancel := mw.nextBatch()
+	go mw.send(ctx, cancel, batch)
+}
+
+// send renews the users of the given batch and releases its slot
+func (mw *databaseRenewBatcherMiddleware) send(ctx context.Context, cancel context.CancelFunc, batch []*pendingRenewal) {
+	defer mw.release()
+	defer cancel()
+
+	requests := make([]RenewRequest, len(batch))
+	for i, p := range batch {
+		requests[i] = p.req
+	}
+
+	for i, err := range mw.renewBatch(ctx, requests) {
+		batch[i].done <- err
+	}
+}
+
+// renewBatch renews the users of a batch, turning a panic into an error for
+// each of them if panicRecovery is set
+func (mw *databaseRenewBatcherMiddleware) renewBatch(ctx context.Context, requests []RenewRequest) (errs []error) {
+	if mw.panicRecovery != nil {
+		var err error
+		defer func() {
+			if err != nil {
+				errs = repeatError(err, len(requests))
+			}
+		}()
+		defer mw.panicRecovery.recover("RenewUsers", &err)
+	}
+
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+// nextBatch takes the next batch off the pending renewals, which must not
+// be empty, along with the context to send it with. The caller must hold
+// the lock.
+func (mw *databaseRenewBatcherMiddleware) nextBatch() ([]*pendingRenewal, context.Context, context.CancelFunc) {
+	maxRequests := mw.maxRequests
+	if maxRequests <= 0 {
+		maxRequests = defaultRenewBatchMaxRequests
+	}
+	maxSize := mw.maxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxStatementSize
+	}
+
+	n, size := 1, proto.Size(&mw.pending[0].req.Statements)
+	for ; n < len(mw.pending) && n < maxRequests; n++ {
+		size += proto.Size(&mw.pending[n].req.Statements)
+		if size > maxSize {
+			break
+		}
+	}
+
+	batch := mw.pending[:n:n]
+	mw.pending = mw.pending[n:]
+
+	// The batch is bound by the latest deadline of its renewals, so that it
+	// is not cut short for those still waiting for it; abandon cancels it
+	// once none are
+	var ctx context.Context = valuesContext{batch[0].ctx}
+	var deadline time.Time
+	for _, p := range batch {
+		d, ok := p.ctx.Deadline()
+		if !ok {
+			deadline = time.Time{}
+			break
+		}
+		if d.After(deadline) {
+			deadline = d
+		}
+	}
+
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+
+	rb := &renewalBatch{
+		waiting: len(batch),
+		cancel:  cancel,
+	}
+	for _, p := range batch {
+		p.batch = rb
+	}
+
+	return batch, ctx, cancel
+}
+
+func (mw *databaseRenewBatcherMiddleware) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	return RenewUsers(ctx, mw.next, requests)
+}
+
+func (mw *databaseRenewBatcherMiddleware) RevokeUser(ctx context.Context, statements Statements, username string) error {
+	return mw.next.RevokeUser(ctx, statements, username)
+}
+
+func (mw *databaseRenewBatcherMiddleware) Initialize(ctx context.Context, conf map[string]interface{}, verifyConnection bool) error {
+	return mw.next.Initialize(ctx, conf, verifyConnection)
+}
+
+func (mw *databaseRenewBatcherMiddleware) Close() error {
+	return mw.next.Close()
+}
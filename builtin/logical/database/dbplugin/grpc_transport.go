@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/hashicorp/vault/helper/pluginutil"
@@ -56,6 +61,39 @@ func (s *gRPCServer) RenewUser(ctx context.Context, req *RenewUserRequest) (*Emp
 	return &Empty{}, err
 }
 
+func (s *gRPCServer) RenewUsers(ctx context.Context, req *RenewUsersRequest) (*RenewUsersResponse, error) {
+	batcher, ok := s.impl.(BatchRenewer)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, errBatchRenewalUnsupported.Error())
+	}
+
+	requests := make([]RenewRequest, len(req.Requests))
+	for i, r := range req.Requests {
+		e, err := ptypes.Timestamp(r.Expiration)
+		if err != nil {
+			return nil, err
+		}
+
+		requests[i] = RenewRequest{
+			Statements: *r.Statements,
+			Username:   r.Username,
+			Expiration: e,
+		}
+	}
+
+	errs := batcher.RenewUsers(ctx, requests)
+
+	resp := &RenewUsersResponse{
+		Errors: make([]string, len(errs)),
+	}
+	for i, err := range errs {
+		if err != nil {
+			resp.Errors[i] = err.Error()
+		}
+	}
+	return resp, nil
+}
+
 func (s *gRPCServer) RevokeUser(ctx context.Context, req *RevokeUserRequest) (*Empty, error) {
 	err := s.impl.RevokeUser(ctx, *req.Statements, req.Username)
 	return &Empty{}, err
@@ -78,13 +116,45 @@ func (s *gRPCServer) Close(_ context.Context, _ *Empty) (*Empty, error) {
 	return &Empty{}, nil
 }
 
+func (s *gRPCServer) Version(context.Context, *Empty) (*VersionResponse, error) {
+	return &VersionResponse{
+		Version: PluginVersion(s.impl),
+	}, nil
+}
+
 // ---- gRPC client domain ----
 
+// recordPeer records the TransportInfo of the connection described by p as
+// the transport information of the operation performed with ctx
+func recordPeer(ctx context.Context, p *peer.Peer) {
+	// The call failed before reaching the plugin
+	if p.Addr == nil {
+		return
+	}
+
+	info := TransportInfo{
+		Transport: "gRPC",
+	}
+
+	// Plugins run by Vault require and verify a client certificate, so the
+	// connection is mutually authenticated once the plugin's certificate is
+	// verified as well
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		info.MutualTLS = tlsInfo.State.HandshakeComplete && len(tlsInfo.State.VerifiedChains) > 0
+	}
+
+	recordTransportInfo(ctx, info)
+}
+
 type gRPCClient struct {
 	client     DatabaseClient
 	clientConn *grpc.ClientConn
 
 	doneCtx context.Context
+
+	// batchUnsupported is set once the plugin failed a RenewUsers call for
+	// not renewing users in batches
+	batchUnsupported int32
 }
 
 func (c gRPCClient) Type() (string, error) {
@@ -107,11 +177,13 @@ func (c gRPCClient) CreateUser(ctx context.Context, statements Statements, usern
 	defer close(quitCh)
 	defer cancel()
 
+	var p peer.Peer
 	resp, err := c.client.CreateUser(ctx, &CreateUserRequest{
 		Statements:     &statements,
 		UsernameConfig: &usernameConfig,
 		Expiration:     t,
-	})
+	}, grpc.Peer(&p))
+	recordPeer(ctx, &p)
 	if err != nil {
 		if c.doneCtx.Err() != nil {
 			return "", "", ErrPluginShutdown
@@ -134,11 +206,13 @@ func (c *gRPCClient) RenewUser(ctx context.Context, statements Statements, usern
 	defer close(quitCh)
 	defer cancel()
 
+	var p peer.Peer
 	_, err = c.client.RenewUser(ctx, &RenewUserRequest{
 		Statements: &statements,
 		Username:   username,
 		Expiration: t,
-	})
+	}, grpc.Peer(&p))
+	recordPeer(ctx, &p)
 	if err != nil {
 		if c.doneCtx.Err() != nil {
 			return ErrPluginShutdown
@@ -150,16 +224,87 @@ func (c *gRPCClient) RenewUser(ctx context.Context, statements Statements, usern
 	return nil
 }
 
+// RenewUsers renews the users of the given requests in a single call.
+// Plugins which don't renew users in batches, including those built before
+// the RenewUsers call was added, fail it with an Unimplemented error, in
+// which case the users are renewed one by one, as they are in later calls.
+func (c *gRPCClient) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	if !c.supportsBatchRenewal() {
+		return c.renewUsersOneByOne(ctx, requests)
+	}
+
+	req := &RenewUsersRequest{
+		Requests: make([]*RenewUserRequest, len(requests)),
+	}
+	for i := range requests {
+		t, err := ptypes.TimestampProto(requests[i].Expiration)
+		if err != nil {
+			return repeatError(err, len(requests))
+		}
+
+		req.Requests[i] = &RenewUserRequest{
+			Statements: &requests[i].Statements,
+			Username:   requests[i].Username,
+			Expiration: t,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	quitCh := pluginutil.CtxCancelIfCanceled(cancel, c.doneCtx)
+	defer close(quitCh)
+	defer cancel()
+
+	var p peer.Peer
+	resp, err := c.client.RenewUsers(ctx, req, grpc.Peer(&p))
+	recordPeer(ctx, &p)
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			atomic.StoreInt32(&c.batchUnsupported, 1)
+			return c.renewUsersOneByOne(ctx, requests)
+		}
+
+		if c.doneCtx.Err() != nil {
+			return repeatError(ErrPluginShutdown, len(requests))
+		}
+
+		return repeatError(err, len(requests))
+	}
+
+	errs := make([]error, len(resp.Errors))
+	for i, msg := range resp.Errors {
+		if msg != "" {
+			errs[i] = errors.New(msg)
+		}
+	}
+	return errs
+}
+
+func (c *gRPCClient) renewUsersOneByOne(ctx context.Context, requests []RenewRequest) []error {
+	errs := make([]error, len(requests))
+	for i, r := range requests {
+		errs[i] = c.RenewUser(ctx, r.Statements, r.Username, r.Expiration)
+	}
+	return errs
+}
+
+// supportsBatchRenewal returns whether the plugin may renew users in
+// batches, which is assumed until a RenewUsers call proves otherwise
+func (c *gRPCClient) supportsBatchRenewal() bool {
+	return atomic.LoadInt32(&c.batchUnsupported) == 0
+}
+
 func (c *gRPCClient) RevokeUser(ctx context.Context, statements Statements, username string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	quitCh := pluginutil.CtxCancelIfCanceled(cancel, c.doneCtx)
 	defer close(quitCh)
 	defer cancel()
 
+	var p peer.Peer
 	_, err := c.client.RevokeUser(ctx, &RevokeUserRequest{
 		Statements: &statements,
 		Username:   username,
-	})
+	}, grpc.Peer(&p))
+	recordPeer(ctx, &p)
 
 	if err != nil {
 		if c.doneCtx.Err() != nil {
@@ -183,10 +328,12 @@ func (c *gRPCClient) Initialize(ctx context.Context, config map[string]interface
 	defer close(quitCh)
 	defer cancel()
 
+	var p peer.Peer
 	_, err = c.client.Initialize(ctx, &InitializeRequest{
 		Config:           configRaw,
 		VerifyConnection: verifyConnection,
-	})
+	}, grpc.Peer(&p))
+	recordPeer(ctx, &p)
 	if err != nil {
 		if c.doneCtx.Err() != nil {
 			return ErrPluginShutdown
@@ -202,3 +349,14 @@ func (c *gRPCClient) Close() error {
 	_, err := c.client.Close(c.doneCtx, &Empty{})
 	return err
 }
+
+// Version returns the version reported by the plugin. Plugins built before
+// the Version call was added fail with an Unimplemented error.
+func (c *gRPCClient) Version() (string, error) {
+	resp, err := c.client.Version(c.doneCtx, &Empty{})
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Version, nil
+}
@@ -2,8 +2,11 @@ package dbplugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/rpc"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,6 +35,32 @@ func (ds *databasePluginRPCServer) RenewUser(args *RenewUserRequestRPC, _ *struc
 	return err
 }
 
+func (ds *databasePluginRPCServer) RenewUsers(args []RenewUserRequestRPC, resp *[]string) error {
+	batcher, ok := ds.impl.(BatchRenewer)
+	if !ok {
+		return errBatchRenewalUnsupported
+	}
+
+	requests := make([]RenewRequest, len(args))
+	for i, r := range args {
+		requests[i] = RenewRequest{
+			Statements: r.Statements,
+			Username:   r.Username,
+			Expiration: r.Expiration,
+		}
+	}
+
+	errs := batcher.RenewUsers(context.Background(), requests)
+
+	*resp = make([]string, len(errs))
+	for i, err := range errs {
+		if err != nil {
+			(*resp)[i] = err.Error()
+		}
+	}
+	return nil
+}
+
 func (ds *databasePluginRPCServer) RevokeUser(args *RevokeUserRequestRPC, _ *struct{}) error {
 	err := ds.impl.RevokeUser(context.Background(), args.Statements, args.Username)
 	return err
@@ -47,11 +76,21 @@ func (ds *databasePluginRPCServer) Close(_ struct{}, _ *struct{}) error {
 	return nil
 }
 
+func (ds *databasePluginRPCServer) Version(_ struct{}, resp *string) error {
+	*resp = PluginVersion(ds.impl)
+	return nil
+}
+
 // ---- RPC client domain ----
 // databasePluginRPCClient implements Database and is used on the client to
-// make RPC calls to a plugin.
+// make RPC calls to a plugin. net/rpc doesn't expose the connection, so the
+// transport of its operations isn't recorded.
 type databasePluginRPCClient struct {
 	client *rpc.Client
+
+	// batchUnsupported is set once the plugin failed a RenewUsers call for
+	// not renewing users in batches
+	batchUnsupported int32
 }
 
 func (dr *databasePluginRPCClient) Type() (string, error) {
@@ -86,6 +125,58 @@ func (dr *databasePluginRPCClient) RenewUser(_ context.Context, statements State
 	return err
 }
 
+// RenewUsers renews the users of the given requests in a single call.
+// Plugins which don't renew users in batches, or were built before the
+// RenewUsers call was added, fail it, in which case the users are renewed one
+// by one, as they are in later calls.
+func (dr *databasePluginRPCClient) RenewUsers(ctx context.Context, requests []RenewRequest) []error {
+	if !dr.supportsBatchRenewal() {
+		return dr.renewUsersOneByOne(ctx, requests)
+	}
+
+	req := make([]RenewUserRequestRPC, len(requests))
+	for i, r := range requests {
+		req[i] = RenewUserRequestRPC{
+			Statements: r.Statements,
+			Username:   r.Username,
+			Expiration: r.Expiration,
+		}
+	}
+
+	var resp []string
+	err := dr.client.Call("Plugin.RenewUsers", req, &resp)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); ok && (err.Error() == errBatchRenewalUnsupported.Error() || strings.Contains(err.Error(), "can't find method")) {
+			atomic.StoreInt32(&dr.batchUnsupported, 1)
+			return dr.renewUsersOneByOne(ctx, requests)
+		}
+
+		return repeatError(err, len(requests))
+	}
+
+	errs := make([]error, len(resp))
+	for i, msg := range resp {
+		if msg != "" {
+			errs[i] = errors.New(msg)
+		}
+	}
+	return errs
+}
+
+func (dr *databasePluginRPCClient) renewUsersOneByOne(ctx context.Context, requests []RenewRequest) []error {
+	errs := make([]error, len(requests))
+	for i, r := range requests {
+		errs[i] = dr.RenewUser(ctx, r.Statements, r.Username, r.Expiration)
+	}
+	return errs
+}
+
+// supportsBatchRenewal returns whether the plugin may renew users in
+// batches, which is assumed until a RenewUsers call proves otherwise
+func (dr *databasePluginRPCClient) supportsBatchRenewal() bool {
+	return atomic.LoadInt32(&dr.batchUnsupported) == 0
+}
+
 func (dr *databasePluginRPCClient) RevokeUser(_ context.Context, statements Statements, username string) error {
 	req := RevokeUserRequestRPC{
 		Statements: statements,
@@ -114,6 +205,13 @@ func (dr *databasePluginRPCClient) Close() error {
 	return err
 }
 
+func (dr *databasePluginRPCClient) Version() (string, error) {
+	var version string
+	err := dr.client.Call("Plugin.Version", struct{}{}, &version)
+
+	return version, err
+}
+
 // ---- RPC Request Args Domain ----
 
 type InitializeRequestRPC struct {
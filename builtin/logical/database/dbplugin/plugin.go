@@ -2,8 +2,10 @@ package dbplugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/rpc"
+	"sync"
 	"time"
 
 	"google.golang.org/grpc"
@@ -24,49 +26,173 @@ type Database interface {
 	Close() error
 }
 
-// PluginFactory is used to build plugin database types. It wraps the database
-// object in a logging and metrics middleware.
-func PluginFactory(ctx context.Context, pluginName string, sys pluginutil.LookRunnerUtil, logger log.Logger) (Database, error) {
-	// Look for plugin in the plugin catalog
-	pluginRunner, err := sys.LookupPlugin(ctx, pluginName)
+// RenewRequest holds the parameters of a RenewUser call.
+type RenewRequest struct {
+	Statements Statements
+	Username   string
+	Expiration time.Time
+}
+
+// BatchRenewer is implemented by databases able to renew several users in a
+// single call, which saves round trips when many leases expire at once.
+type BatchRenewer interface {
+	// RenewUsers renews the users of the given requests. The returned
+	// slice holds the error of each request, in order.
+	RenewUsers(ctx context.Context, requests []RenewRequest) []error
+}
+
+// RenewUsers renews the users of the given requests in a single call if db
+// implements BatchRenewer, and by calling RenewUser for each of them
+// otherwise. The returned slice holds the error of each request, in order.
+func RenewUsers(ctx context.Context, db Database, requests []RenewRequest) []error {
+	if batcher, ok := db.(BatchRenewer); ok {
+		errs := batcher.RenewUsers(ctx, requests)
+		if len(errs) == len(requests) {
+			return errs
+		}
+
+		return repeatError(fmt.Errorf("batch renewal returned %d results for %d requests", len(errs), len(requests)), len(requests))
+	}
+
+	errs := make([]error, len(requests))
+	for i, req := range requests {
+		errs[i] = db.RenewUser(ctx, req.Statements, req.Username, req.Expiration)
+	}
+	return errs
+}
+
+// errBatchRenewalUnsupported is returned by the plugin servers when the
+// plugin doesn't implement BatchRenewer
+var errBatchRenewalUnsupported = errors.New("database doesn't renew users in batches")
+
+// batchRenewalSupporter is implemented by the plugin clients, which can tell
+// whether the plugin may renew users in batches itself. This is only known
+// once a batch has been sent to the plugin, since plugins may reject calls
+// before they are initialized.
+type batchRenewalSupporter interface {
+	supportsBatchRenewal() bool
+}
+
+// repeatError returns a slice of n errors all set to err, for batches which
+// failed as a whole
+func repeatError(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Versioner is implemented by databases able to report the version of
+// their build, which is then added to the trace logs of their operations.
+type Versioner interface {
+	Version() (string, error)
+}
+
+// PluginVersion returns the version reported by db if it implements
+// Versioner, and an empty string otherwise or if it fails to report one.
+func PluginVersion(db Database) string {
+	versioner, ok := db.(Versioner)
+	if !ok {
+		return ""
+	}
+
+	version, err := versioner.Version()
 	if err != nil {
-		return nil, err
+		return ""
 	}
+	return version
+}
+
+// FactoryConfig holds the settings of the optional middlewares the database
+// object is wrapped in by PluginFactoryWithConfig. The zero value of each
+// setting disables the corresponding middleware.
+type FactoryConfig struct {
+	// MaxConcurrentOperations is the maximum number of operations running
+	// concurrently against the database. Further operations wait for one of
+	// them to complete.
+	MaxConcurrentOperations int
+
+	// MaxCredentials is the maximum number of credentials created through
+	// the database object and not yet revoked. Only the credentials created
+	// by the database object are counted: those created by previous
+	// instances, e.g. before the connection was reset or Vault restarted,
+	// are not, and revoking them doesn't free up room for new ones.
+	MaxCredentials int
+
+	// RevocationCacheTTL is how long revoked users are remembered, during
+	// which revoking them again succeeds without calling the plugin.
+	RevocationCacheTTL time.Duration
 
-	var transport string
-	var db Database
+	// ReplicaConnectionURLs holds the connection URLs of read replicas of
+	// the database. Each replica is reached through its own instance of the
+	// plugin, initialized with the connection configuration of the database
+	// and the replica's URL as connection_url. Reads are spread across the
+	// replicas, while the users are always managed on the database itself.
+	ReplicaConnectionURLs []string
+}
+
+// newDatabase returns a new instance of the database of the given plugin,
+// along with the transport used to reach it.
+func newDatabase(ctx context.Context, pluginName string, pluginRunner *pluginutil.PluginRunner, sys pluginutil.LookRunnerUtil, logger log.Logger) (db Database, transport string, err error) {
 	if pluginRunner.Builtin {
 		// Plugin is builtin so we can retrieve an instance of the interface
 		// from the pluginRunner. Then cast it to a Database.
 		dbRaw, err := pluginRunner.BuiltinFactory()
 		if err != nil {
-			return nil, fmt.Errorf("error getting plugin type: %s", err)
+			return nil, "", fmt.Errorf("error getting plugin type: %s", err)
 		}
 
 		var ok bool
 		db, ok = dbRaw.(Database)
 		if !ok {
-			return nil, fmt.Errorf("unsuported database type: %s", pluginName)
+			return nil, "", fmt.Errorf("unsuported database type: %s", pluginName)
 		}
 
-		transport = "builtin"
+		return db, "builtin", nil
+	}
 
-	} else {
-		// create a DatabasePluginClient instance
-		db, err = newPluginClient(ctx, sys, pluginRunner, logger)
-		if err != nil {
-			return nil, err
-		}
+	// create a DatabasePluginClient instance
+	db, err = newPluginClient(ctx, sys, pluginRunner, logger)
+	if err != nil {
+		return nil, "", err
+	}
 
-		// Switch on the underlying database client type to get the transport
-		// method.
-		switch db.(*DatabasePluginClient).Database.(type) {
-		case *gRPCClient:
-			transport = "gRPC"
-		case *databasePluginRPCClient:
-			transport = "netRPC"
-		}
+	// Switch on the underlying database client type to get the transport
+	// method.
+	switch db.(*DatabasePluginClient).Database.(type) {
+	case *gRPCClient:
+		transport = "gRPC"
+	case *databasePluginRPCClient:
+		transport = "netRPC"
+	}
+
+	return db, transport, nil
+}
+
+// PluginFactory is used to build plugin database types. It wraps the database
+// object in a logging and metrics middleware, redacts secrets from the errors
+// it returns and recovers from its panics.
+func PluginFactory(ctx context.Context, pluginName string, sys pluginutil.LookRunnerUtil, logger log.Logger) (Database, error) {
+	return PluginFactoryWithConfig(ctx, pluginName, sys, logger, nil)
+}
 
+// PluginFactoryWithConfig is PluginFactory with the optional middlewares set
+// up according to the given configuration, which may be nil.
+func PluginFactoryWithConfig(ctx context.Context, pluginName string, sys pluginutil.LookRunnerUtil, logger log.Logger, config *FactoryConfig) (Database, error) {
+	if config == nil {
+		config = &FactoryConfig{}
+	}
+
+	// Look for plugin in the plugin catalog
+	pluginRunner, err := sys.LookupPlugin(ctx, pluginName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, transport, err := newDatabase(ctx, pluginName, pluginRunner, sys, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	typeStr, err := db.Type()
@@ -74,6 +200,111 @@ func PluginFactory(ctx context.Context, pluginName string, sys pluginutil.LookRu
 		return nil, fmt.Errorf("error getting plugin type: %s", err)
 	}
 
+	version := PluginVersion(db)
+
+	// Renewals are only worth batching if the database renews users in
+	// batches itself, rather than one after the other. The client of plugins
+	// always implements BatchRenewer, and finds out whether the plugin does
+	// with the first batch.
+	_, batchRenewals := db.(BatchRenewer)
+	var batchSupported func() bool
+	if client, ok := db.(*DatabasePluginClient); ok {
+		batchSupported = client.supportsBatchRenewal
+	}
+
+	// Wrap with replica middleware, if configured, so that the other
+	// middlewares apply to the replicas too
+	if len(config.ReplicaConnectionURLs) > 0 {
+		replicas := make([]Database, 0, len(config.ReplicaConnectionURLs))
+		for range config.ReplicaConnectionURLs {
+			replica, _, err := newDatabase(ctx, pluginName, pluginRunner, sys, logger)
+			if err != nil {
+				db.Close()
+				for _, replica := range replicas {
+					replica.Close()
+				}
+				return nil, fmt.Errorf("error creating replica: %s", err)
+			}
+			replicas = append(replicas, replica)
+		}
+
+		db = &databaseReplicaMiddleware{
+			primary:        db,
+			replicas:       replicas,
+			connectionURLs: config.ReplicaConnectionURLs,
+		}
+	}
+
+	// Wrap with statement error middleware, which points out the failed
+	// statement. Only the errors of builtin plugins keep their type.
+	db = &databaseStatementErrorMiddleware{
+		next: db,
+	}
+
+	// Wrap with error translator middleware, which explains the common
+	// errors of the database drivers
+	db = &databaseErrorTranslatorMiddleware{
+		next:         db,
+		translations: defaultErrorTranslations,
+	}
+
+	// Wrap with error sanitizer middleware, which redacts the secrets of the
+	// connection configuration from the errors of the plugin
+	sanitizer := &databaseErrorSanitizerMiddleware{
+		next: db,
+	}
+	if len(config.ReplicaConnectionURLs) > 0 {
+		// The configuration the sanitizer is initialized with lacks the
+		// connection URLs of the replicas
+		replicaConf := make(map[string]interface{}, len(config.ReplicaConnectionURLs))
+		for i, connURL := range config.ReplicaConnectionURLs {
+			replicaConf[fmt.Sprintf("replica_%d", i)] = connURL
+		}
+		replicaSecrets := connectionSecrets(replicaConf)
+		sanitizer.secretsFn = func() []string {
+			return replicaSecrets
+		}
+	}
+	db = sanitizer
+
+	// Wrap with statement size middleware, which rejects the statements too
+	// large for the plugin transport
+	db = &databaseStatementSizeMiddleware{
+		next: db,
+	}
+
+	// Wrap with credential limit middleware, if configured
+	if config.MaxCredentials > 0 {
+		db = &databaseCredentialLimitMiddleware{
+			next:  db,
+			limit: config.MaxCredentials,
+		}
+	}
+
+	// Wrap with concurrency limit middleware, if configured
+	if config.MaxConcurrentOperations > 0 {
+		db = newDatabaseConcurrencyLimitMiddleware(db, config.MaxConcurrentOperations, false)
+	}
+
+	// Wrap with idempotent revoke middleware, if configured
+	if config.RevocationCacheTTL > 0 {
+		db = newDatabaseIdempotentRevokeMiddleware(db, config.RevocationCacheTTL)
+	}
+
+	// Wrap with cancellation middleware, which reports the operations whose
+	// context is done with ErrOperationCancelled
+	db = &databaseCancellationMiddleware{
+		next: db,
+	}
+
+	// Wrap with lease deadline middleware, which gives up creating users
+	// once their credentials expired. It goes around the cancellation
+	// middleware so that the operations it times out are reported with
+	// ErrOperationCancelled too.
+	db = &databaseLeaseDeadlineMiddleware{
+		next: db,
+	}
+
 	// Wrap with metrics middleware
 	db = &databaseMetricsMiddleware{
 		next:    db,
@@ -86,10 +317,33 @@ func PluginFactory(ctx context.Context, pluginName string, sys pluginutil.LookRu
 			transport: transport,
 			next:      db,
 			typeStr:   typeStr,
+			version:   version,
 			logger:    logger,
 		}
 	}
 
+	panicRecovery := &databasePanicRecoveryMiddleware{
+		logger:    logger,
+		secretsFn: sanitizer.secrets,
+	}
+
+	// Wrap with renewal batcher middleware, which sends concurrent renewals
+	// to the database together. It goes around the other middlewares so that
+	// they handle the batches too, and recovers from the panics of the
+	// batches it sends from its own goroutines.
+	if batchRenewals {
+		db = &databaseRenewBatcherMiddleware{
+			next:          db,
+			supported:     batchSupported,
+			panicRecovery: panicRecovery,
+		}
+	}
+
+	// Wrap with panic recovery middleware, around the other middlewares so
+	// that it recovers from their panics too
+	panicRecovery.next = db
+	db = panicRecovery
+
 	return db, nil
 }
 
@@ -132,3 +386,95 @@ func (DatabasePlugin) GRPCClient(doneCtx context.Context, _ *plugin.GRPCBroker,
 		doneCtx:    doneCtx,
 	}, nil
 }
+
+// transportInfoContextKey is the context key under which the TransportInfo
+// of an operation is stored
+type transportInfoContextKey struct{}
+
+// TransportInfo describes the connection used to communicate with a database
+// plugin for a given operation.
+type TransportInfo struct {
+	// Transport is the name of the transport, e.g. "gRPC" or "netRPC"
+	Transport string
+
+	// MutualTLS is true if both ends of the connection were authenticated
+	MutualTLS bool
+}
+
+// ContextWithTransportInfo returns a copy of ctx carrying the given transport
+// information, which is recorded by the tracing middleware.
+func ContextWithTransportInfo(ctx context.Context, info TransportInfo) context.Context {
+	return context.WithValue(ctx, transportInfoContextKey{}, info)
+}
+
+// TransportInfoFromContext returns the transport information carried by ctx,
+// if any. Transport information recorded by the plugin RPC client for the
+// operation performed with ctx takes precedence.
+func TransportInfoFromContext(ctx context.Context) (TransportInfo, bool) {
+	if recorder, ok := ctx.Value(transportInfoRecorderContextKey{}).(*transportInfoRecorder); ok {
+		if info, ok := recorder.get(); ok {
+			return info, true
+		}
+	}
+
+	info, ok := ctx.Value(transportInfoContextKey{}).(TransportInfo)
+	return info, ok
+}
+
+// transportInfoRecorderContextKey is the context key under which the
+// recorder of the TransportInfo of an operation is stored
+type transportInfoRecorderContextKey struct{}
+
+// transportInfoRecorder collects the TransportInfo of an operation from the
+// plugin RPC client, which only learns it while performing the operation,
+// for the middlewares the operation went through.
+type transportInfoRecorder struct {
+	l    sync.Mutex
+	info *TransportInfo
+}
+
+func (r *transportInfoRecorder) get() (TransportInfo, bool) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.info == nil {
+		return TransportInfo{}, false
+	}
+	return *r.info, true
+}
+
+// contextWithTransportInfoRecorder returns a copy of ctx carrying a recorder
+// of the TransportInfo of the operation it is used for, which is then
+// returned by TransportInfoFromContext.
+func contextWithTransportInfoRecorder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, transportInfoRecorderContextKey{}, &transportInfoRecorder{})
+}
+
+// recordTransportInfo records info as the transport information of the
+// operation performed with ctx, if ctx carries a recorder.
+func recordTransportInfo(ctx context.Context, info TransportInfo) {
+	recorder, ok := ctx.Value(transportInfoRecorderContextKey{}).(*transportInfoRecorder)
+	if !ok {
+		return
+	}
+
+	recorder.l.Lock()
+	recorder.info = &info
+	recorder.l.Unlock()
+}
+
+// roleNameContextKey is the context key under which the name of the role an
+// operation is performed for is stored
+type roleNameContextKey struct{}
+
+// ContextWithRoleName returns a copy of ctx carrying the name of the role the
+// operation is performed for, which is used to label metrics.
+func ContextWithRoleName(ctx context.Context, roleName string) context.Context {
+	return context.WithValue(ctx, roleNameContextKey{}, roleName)
+}
+
+// RoleNameFromContext returns the role name carried by ctx, if any.
+func RoleNameFromContext(ctx context.Context) (string, bool) {
+	roleName, ok := ctx.Value(roleNameContextKey{}).(string)
+	return roleName, ok && roleName != ""
+}
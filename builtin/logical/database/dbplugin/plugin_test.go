@@ -1,14 +1,18 @@
 package dbplugin_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	plugin "github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
+	"github.com/hashicorp/vault/helper/logformat"
 	"github.com/hashicorp/vault/helper/pluginutil"
 	vaulthttp "github.com/hashicorp/vault/http"
 	"github.com/hashicorp/vault/logical"
@@ -48,6 +52,15 @@ func (m *mockPlugin) RenewUser(_ context.Context, statements dbplugin.Statements
 
 	return nil
 }
+func (m *mockPlugin) RenewUsers(_ context.Context, requests []dbplugin.RenewRequest) []error {
+	errs := make([]error, len(requests))
+	for i, req := range requests {
+		if _, ok := m.users[req.Username]; !ok {
+			errs[i] = errors.New("batch err")
+		}
+	}
+	return errs
+}
 func (m *mockPlugin) RevokeUser(_ context.Context, statements dbplugin.Statements, username string) error {
 	err := errors.New("err")
 	if username == "" {
@@ -73,6 +86,7 @@ func (m *mockPlugin) Close() error {
 	m.users = nil
 	return nil
 }
+func (m *mockPlugin) Version() (string, error) { return "1.0.0", nil }
 
 func getCluster(t *testing.T) (*vault.TestCluster, logical.SystemView) {
 	cluster := vault.NewTestCluster(t, nil, &vault.TestClusterOptions{
@@ -156,6 +170,76 @@ func TestPlugin_Initialize(t *testing.T) {
 	}
 }
 
+// syncBuffer is a bytes.Buffer safe for concurrent use, as the plugin logs
+// are written from other goroutines
+type syncBuffer struct {
+	l   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.buf.String()
+}
+
+func TestPlugin_TransportInfo(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	var buf syncBuffer
+	db, err := dbplugin.PluginFactory(context.Background(), "test-plugin", sys, logformat.NewVaultLoggerWithWriter(&buf, log.LevelTrace))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	connectionDetails := map[string]interface{}{
+		"test": 1,
+	}
+
+	err = db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The gRPC client records the mutually authenticated connection
+	if !strings.Contains(buf.String(), "operation=Initialize status=finished type=mock transport=gRPC mutual_tls=true") {
+		t.Fatalf("expected the transport to be recorded; logs: %s", buf.String())
+	}
+}
+
+func TestPlugin_Version(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	var buf syncBuffer
+	db, err := dbplugin.PluginFactory(context.Background(), "test-plugin", sys, logformat.NewVaultLoggerWithWriter(&buf, log.LevelTrace))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	connectionDetails := map[string]interface{}{
+		"test": 1,
+	}
+
+	err = db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.Contains(buf.String(), "operation=Initialize status=finished type=mock") || !strings.Contains(buf.String(), "version=1.0.0") {
+		t.Fatalf("expected the plugin version to be traced; logs: %s", buf.String())
+	}
+}
+
 func TestPlugin_CreateUser(t *testing.T) {
 	cluster, sys := getCluster(t)
 	defer cluster.Cleanup()
@@ -230,6 +314,51 @@ func TestPlugin_RenewUser(t *testing.T) {
 	}
 }
 
+func TestPlugin_RenewUsers(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	db, err := dbplugin.PluginFactory(context.Background(), "test-plugin", sys, &log.NullLogger{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	connectionDetails := map[string]interface{}{
+		"test": 1,
+	}
+	err = db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	usernameConf := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+
+	us, _, err := db.CreateUser(context.Background(), dbplugin.Statements{}, usernameConf, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errs := dbplugin.RenewUsers(context.Background(), db, []dbplugin.RenewRequest{
+		{Username: us, Expiration: time.Now().Add(time.Minute)},
+		{Username: "unknown", Expiration: time.Now().Add(time.Minute)},
+	})
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(errs))
+	}
+	if errs[0] != nil {
+		t.Fatalf("err: %s", errs[0])
+	}
+
+	// The plugin renewed the users in a single call
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "batch err") {
+		t.Fatalf("expected the error of the batch renewal, got %v", errs[1])
+	}
+}
+
 func TestPlugin_RevokeUser(t *testing.T) {
 	cluster, sys := getCluster(t)
 	defer cluster.Cleanup()
@@ -296,6 +425,31 @@ func TestPlugin_NetRPC_Initialize(t *testing.T) {
 	}
 }
 
+func TestPlugin_NetRPC_Version(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	var buf syncBuffer
+	db, err := dbplugin.PluginFactory(context.Background(), "test-plugin-netRPC", sys, logformat.NewVaultLoggerWithWriter(&buf, log.LevelTrace))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	connectionDetails := map[string]interface{}{
+		"test": 1,
+	}
+
+	err = db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !strings.Contains(buf.String(), "operation=Initialize status=finished type=plugin-mock") || !strings.Contains(buf.String(), "version=1.0.0") {
+		t.Fatalf("expected the plugin version to be traced; logs: %s", buf.String())
+	}
+}
+
 func TestPlugin_NetRPC_CreateUser(t *testing.T) {
 	cluster, sys := getCluster(t)
 	defer cluster.Cleanup()
@@ -370,6 +524,51 @@ func TestPlugin_NetRPC_RenewUser(t *testing.T) {
 	}
 }
 
+func TestPlugin_NetRPC_RenewUsers(t *testing.T) {
+	cluster, sys := getCluster(t)
+	defer cluster.Cleanup()
+
+	db, err := dbplugin.PluginFactory(context.Background(), "test-plugin-netRPC", sys, &log.NullLogger{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+
+	connectionDetails := map[string]interface{}{
+		"test": 1,
+	}
+	err = db.Initialize(context.Background(), connectionDetails, true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	usernameConf := dbplugin.UsernameConfig{
+		DisplayName: "test",
+		RoleName:    "test",
+	}
+
+	us, _, err := db.CreateUser(context.Background(), dbplugin.Statements{}, usernameConf, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	errs := dbplugin.RenewUsers(context.Background(), db, []dbplugin.RenewRequest{
+		{Username: us, Expiration: time.Now().Add(time.Minute)},
+		{Username: "unknown", Expiration: time.Now().Add(time.Minute)},
+	})
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(errs))
+	}
+	if errs[0] != nil {
+		t.Fatalf("err: %s", errs[0])
+	}
+
+	// The plugin renewed the users in a single call
+	if errs[1] == nil || !strings.Contains(errs[1].Error(), "batch err") {
+		t.Fatalf("expected the error of the batch renewal, got %v", errs[1])
+	}
+}
+
 func TestPlugin_NetRPC_RevokeUser(t *testing.T) {
 	cluster, sys := getCluster(t)
 	defer cluster.Cleanup()
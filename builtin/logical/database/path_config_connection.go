@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/fatih/structs"
 	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
@@ -24,6 +25,29 @@ type DatabaseConfig struct {
 	// by each database type.
 	ConnectionDetails map[string]interface{} `json:"connection_details" structs:"connection_details" mapstructure:"connection_details"`
 	AllowedRoles      []string               `json:"allowed_roles" structs:"allowed_roles" mapstructure:"allowed_roles"`
+	// MaxConcurrentOperations bounds the number of operations running
+	// concurrently against the database; 0 means no limit.
+	MaxConcurrentOperations int `json:"max_concurrent_operations" structs:"max_concurrent_operations,omitempty" mapstructure:"max_concurrent_operations"`
+	// MaxCredentials bounds the number of live credentials created through
+	// the connection; 0 means no limit.
+	MaxCredentials int `json:"max_credentials" structs:"max_credentials,omitempty" mapstructure:"max_credentials"`
+	// RevocationCacheTTL is how long revoked users are remembered so that
+	// revoking them again is a no-op; 0 disables it.
+	RevocationCacheTTL time.Duration `json:"revocation_cache_ttl" structs:"-" mapstructure:"revocation_cache_ttl"`
+	// ReplicaConnectionURLs are the connection URLs of read replicas of the
+	// database.
+	ReplicaConnectionURLs []string `json:"replica_connection_urls" structs:"replica_connection_urls,omitempty" mapstructure:"replica_connection_urls"`
+}
+
+// factoryConfig returns the configuration of the middlewares the database
+// object is wrapped in
+func (c *DatabaseConfig) factoryConfig() *dbplugin.FactoryConfig {
+	return &dbplugin.FactoryConfig{
+		MaxConcurrentOperations: c.MaxConcurrentOperations,
+		MaxCredentials:          c.MaxCredentials,
+		RevocationCacheTTL:      c.RevocationCacheTTL,
+		ReplicaConnectionURLs:   c.ReplicaConnectionURLs,
+	}
 }
 
 // pathResetConnection configures a path to reset a plugin.
@@ -103,6 +127,37 @@ func pathConfigurePluginConnection(b *databaseBackend) *framework.Path {
 				allowed to get creds from this database connection. If empty no
 				roles are allowed. If "*" all roles are allowed.`,
 			},
+
+			"max_concurrent_operations": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The maximum number of operations running
+				concurrently against the database. Further operations wait for
+				one of them to complete. If 0 there is no limit.`,
+			},
+
+			"max_credentials": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The maximum number of credentials created through
+				this connection and not yet revoked. Credentials created before
+				the connection was last reset or Vault last restarted are not
+				counted. If 0 there is no limit.`,
+			},
+
+			"revocation_cache_ttl": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `How long revoked users are remembered, during
+				which revoking them again succeeds without calling the
+				database. If 0 revocations are always sent to the database.`,
+			},
+
+			"replica_connection_urls": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma separated string or array of the connection
+				URLs of read replicas of the database. Each replica is connected
+				to with the other connection details. Reads are spread across
+				the replicas, while users are always managed on the database
+				itself.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -160,9 +215,14 @@ func (b *databaseBackend) connectionReadHandler() framework.OperationFunc {
 		if err := entry.DecodeJSON(&config); err != nil {
 			return nil, err
 		}
-		return &logical.Response{
+
+		resp := &logical.Response{
 			Data: structs.New(config).Map(),
-		}, nil
+		}
+		if config.RevocationCacheTTL > 0 {
+			resp.Data["revocation_cache_ttl"] = config.RevocationCacheTTL.Seconds()
+		}
+		return resp, nil
 	}
 }
 
@@ -213,20 +273,45 @@ func (b *databaseBackend) connectionWriteHandler() framework.OperationFunc {
 
 		allowedRoles := data.Get("allowed_roles").([]string)
 
+		maxConcurrentOperations := data.Get("max_concurrent_operations").(int)
+		if maxConcurrentOperations < 0 {
+			return logical.ErrorResponse("max_concurrent_operations cannot be negative"), nil
+		}
+
+		maxCredentials := data.Get("max_credentials").(int)
+		if maxCredentials < 0 {
+			return logical.ErrorResponse("max_credentials cannot be negative"), nil
+		}
+
+		revocationCacheTTL := time.Duration(data.Get("revocation_cache_ttl").(int)) * time.Second
+		if revocationCacheTTL < 0 {
+			return logical.ErrorResponse("revocation_cache_ttl cannot be negative"), nil
+		}
+
+		replicaConnectionURLs := data.Get("replica_connection_urls").([]string)
+
 		// Remove these entries from the data before we store it keyed under
 		// ConnectionDetails.
 		delete(data.Raw, "name")
 		delete(data.Raw, "plugin_name")
 		delete(data.Raw, "allowed_roles")
 		delete(data.Raw, "verify_connection")
+		delete(data.Raw, "max_concurrent_operations")
+		delete(data.Raw, "max_credentials")
+		delete(data.Raw, "revocation_cache_ttl")
+		delete(data.Raw, "replica_connection_urls")
 
 		config := &DatabaseConfig{
-			ConnectionDetails: data.Raw,
-			PluginName:        pluginName,
-			AllowedRoles:      allowedRoles,
+			ConnectionDetails:       data.Raw,
+			PluginName:              pluginName,
+			AllowedRoles:            allowedRoles,
+			MaxConcurrentOperations: maxConcurrentOperations,
+			MaxCredentials:          maxCredentials,
+			RevocationCacheTTL:      revocationCacheTTL,
+			ReplicaConnectionURLs:   replicaConnectionURLs,
 		}
 
-		db, err := dbplugin.PluginFactory(ctx, config.PluginName, b.System(), b.logger)
+		db, err := dbplugin.PluginFactoryWithConfig(ctx, config.PluginName, b.System(), b.logger, config.factoryConfig())
 		if err != nil {
 			return logical.ErrorResponse(fmt.Sprintf("error creating database object: %s", err)), nil
 		}
@@ -283,6 +368,21 @@ accepts:
 	* "verify_connection" (default: true) - A boolean value denoting if the plugin should verify
 	   it is able to connect to the database using the provided connection
        details.
+
+	* "max_concurrent_operations" (default: 0) - The maximum number of operations
+	   running concurrently against the database. If 0 there is no limit.
+
+	* "max_credentials" (default: 0) - The maximum number of credentials created
+	   through this connection and not yet revoked. Credentials created before
+	   the connection was last reset or Vault last restarted are not counted.
+	   If 0 there is no limit.
+
+	* "revocation_cache_ttl" (default: 0) - How long revoked users are remembered,
+	   during which revoking them again succeeds without calling the database.
+
+	* "replica_connection_urls" (default: "") - The connection URLs of read
+	   replicas of the database, connected to with the other connection
+	   details. Users are always managed on the database itself.
 `
 
 const pathResetConnectionHelpSyn = `
@@ -94,7 +94,7 @@ func (b *databaseBackend) pathCredsCreateRead() framework.OperationFunc {
 		}
 
 		// Create the user
-		username, password, err := db.CreateUser(ctx, role.Statements, usernameConfig, expiration)
+		username, password, err := db.CreateUser(dbplugin.ContextWithRoleName(ctx, name), role.Statements, usernameConfig, expiration)
 		if err != nil {
 			unlockFunc()
 			b.closeIfShutdown(role.DBName, err)
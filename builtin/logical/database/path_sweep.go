@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// sweepConcurrency is the maximum number of revocations a sweep runs
+// concurrently against the database
+const sweepConcurrency = 4
+
+func pathSweep(b *databaseBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "sweep/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the role.",
+			},
+
+			"usernames": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Comma separated string or array of the names of
+				the database users to revoke.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathSweepWrite(),
+		},
+
+		HelpSynopsis:    pathSweepHelpSyn,
+		HelpDescription: pathSweepHelpDesc,
+	}
+}
+
+func (b *databaseBackend) pathSweepWrite() framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+		name := data.Get("name").(string)
+
+		usernames := data.Get("usernames").([]string)
+		if len(usernames) == 0 {
+			return logical.ErrorResponse("usernames are required"), nil
+		}
+
+		// Get the role
+		role, err := b.Role(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("unknown role: %s", name)), nil
+		}
+
+		// Grab the read lock
+		b.RLock()
+		unlockFunc := b.RUnlock
+
+		// Get our connection
+		db, ok := b.getDBObj(role.DBName)
+		if !ok {
+			// Upgrade lock
+			b.RUnlock()
+			b.Lock()
+			unlockFunc = b.Unlock
+
+			// Create a new DB object
+			db, err = b.createDBObj(ctx, req.Storage, role.DBName)
+			if err != nil {
+				unlockFunc()
+				return nil, fmt.Errorf("cound not retrieve db with name: %s, got error: %s", role.DBName, err)
+			}
+		}
+
+		failed := dbplugin.SweepOrphans(dbplugin.ContextWithRoleName(ctx, name), db, role.Statements, usernames, sweepConcurrency)
+		unlockFunc()
+
+		for _, err := range failed {
+			b.closeIfShutdown(role.DBName, err)
+		}
+
+		if len(failed) == 0 {
+			return nil, nil
+		}
+
+		errs := make(map[string]interface{}, len(failed))
+		failedUsernames := make([]string, 0, len(failed))
+		for username, err := range failed {
+			errs[username] = err.Error()
+			failedUsernames = append(failedUsernames, username)
+		}
+		sort.Strings(failedUsernames)
+
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				"errors": errs,
+			},
+		}
+		resp.AddWarning(fmt.Sprintf("failed to revoke %d of %d users: %v", len(failed), len(usernames), failedUsernames))
+		return resp, nil
+	}
+}
+
+const pathSweepHelpSyn = `
+Revoke database users which Vault lost track of.
+`
+
+const pathSweepHelpDesc = `
+This path revokes the given database users of the role, using the revocation
+statements of the role. It is meant to clean up the users Vault lost track of,
+e.g. because their lease was lost, and which are thus never revoked. The users
+are revoked concurrently; those which couldn't be revoked are reported along
+with their error.
+`
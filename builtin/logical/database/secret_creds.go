@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/hashicorp/vault/builtin/logical/database/dbplugin"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -127,7 +128,7 @@ func (b *databaseBackend) secretCredsRevoke() framework.OperationFunc {
 			}
 		}
 
-		if err := db.RevokeUser(ctx, role.Statements, username); err != nil {
+		if err := db.RevokeUser(dbplugin.ContextWithRoleName(ctx, roleNameRaw.(string)), role.Statements, username); err != nil {
 			unlockFunc()
 			b.closeIfShutdown(role.DBName, err)
 			return nil, err
@@ -0,0 +1,202 @@
+package storagepacker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/locksutil"
+)
+
+// ErrBatchDone is returned when using a write batch which has already been
+// committed or discarded
+var ErrBatchDone = errors.New("write batch is already committed or discarded")
+
+// WriteBatch buffers item updates in memory until they are committed. Each
+// bucket touched by the batch is written once on commit, however many of its
+// items were updated.
+type WriteBatch struct {
+	packer *StoragePacker
+	ctx    context.Context
+
+	l    sync.Mutex
+	done bool
+
+	// changes holds the buffered updates by bucket path and item ID. A nil
+	// item marks a deletion.
+	changes map[string]map[string]*Item
+}
+
+// Begin starts a write batch. The context is used when committing the batch.
+func (s *StoragePacker) Begin(ctx context.Context) *WriteBatch {
+	return &WriteBatch{
+		packer:  s,
+		ctx:     ctx,
+		changes: make(map[string]map[string]*Item),
+	}
+}
+
+// PutItem buffers the storage of the given item, replacing any update of the
+// same item buffered earlier.
+func (b *WriteBatch) PutItem(item *Item) error {
+	if item == nil {
+		return fmt.Errorf("nil item")
+	}
+
+	if item.ID == "" {
+		return fmt.Errorf("missing ID in item")
+	}
+
+	if err := b.packer.validateItem(item); err != nil {
+		return err
+	}
+
+	return b.buffer(item.ID, item)
+}
+
+// DeleteItem buffers the removal of the item with the given ID, replacing any
+// update of the same item buffered earlier.
+func (b *WriteBatch) DeleteItem(itemID string) error {
+	if itemID == "" {
+		return fmt.Errorf("empty item ID")
+	}
+
+	return b.buffer(itemID, nil)
+}
+
+func (b *WriteBatch) buffer(itemID string, item *Item) error {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.done {
+		return ErrBatchDone
+	}
+
+	if err := b.packer.checkItemIDLength(itemID); err != nil {
+		return err
+	}
+
+	bucketPath := b.packer.BucketPath(b.packer.BucketKey(itemID))
+	if b.changes[bucketPath] == nil {
+		b.changes[bucketPath] = make(map[string]*Item)
+	}
+	b.changes[bucketPath][itemID] = item
+
+	return nil
+}
+
+// Commit writes the buffered updates. The touched buckets are updated one at
+// a time, in order, each under its write lock. If updating a bucket fails the
+// remaining buckets are left untouched, so a failed commit may have been
+// partially applied. The batch can't be used after Commit is called.
+func (b *WriteBatch) Commit() error {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.done {
+		return ErrBatchDone
+	}
+	b.done = true
+
+	if err := b.packer.checkClosed(); err != nil {
+		return err
+	}
+
+	bucketPaths := make([]string, 0, len(b.changes))
+	for bucketPath := range b.changes {
+		bucketPaths = append(bucketPaths, bucketPath)
+	}
+	sort.Strings(bucketPaths)
+
+	for _, bucketPath := range bucketPaths {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+
+		err := b.commitBucket(bucketPath, b.changes[bucketPath])
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to commit updates of bucket %q: {{err}}", bucketPath), err)
+		}
+	}
+
+	return nil
+}
+
+func (b *WriteBatch) commitBucket(bucketPath string, changes map[string]*Item) error {
+	s := b.packer
+
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(b.ctx, bucketPath)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		bucket = &Bucket{
+			Key: bucketPath,
+		}
+	}
+
+	payloadKeys := bucket.payloadKeys()
+
+	modified := false
+	var removedIDs []string
+	for itemID, item := range changes {
+		if item == nil {
+			if bucket.remove(itemID) {
+				removedIDs = append(removedIDs, itemID)
+				modified = true
+			}
+			continue
+		}
+
+		item, _, err = wholeItem(item)
+		if err != nil {
+			return err
+		}
+
+		existing := bucket.findItem(itemID)
+		if err := s.checkBucketCapacity(bucket, existing); err != nil {
+			return err
+		}
+		item, err = s.stampItem(existing, item)
+		if err != nil {
+			return err
+		}
+		s.checkItemGrowth(existing, item)
+
+		if err := bucket.upsert(item); err != nil {
+			return err
+		}
+		modified = true
+	}
+
+	// Deleting items which don't exist doesn't require a write
+	if !modified {
+		return nil
+	}
+
+	err = s.putBucketRemovingItems(b.ctx, bucket, bucket.Version, removedIDs)
+	if err != nil {
+		return err
+	}
+
+	s.releasePayloads(b.ctx, bucket, payloadKeys)
+
+	return nil
+}
+
+// Discard drops the buffered updates. The batch can't be used after Discard
+// is called.
+func (b *WriteBatch) Discard() {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	b.done = true
+	b.changes = nil
+}
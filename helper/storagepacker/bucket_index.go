@@ -0,0 +1,209 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// bucketIndexKey is the key, relative to the view prefix, under which the
+// index of buckets is stored when Config.IndexBuckets is set. Keys starting
+// with an underscore are reserved by the packer and are never bucket keys.
+const bucketIndexKey = "_index"
+
+// bucketIndexEntry is the persisted form of the bucket index
+type bucketIndexEntry struct {
+	Buckets []string         `json:"buckets"`
+	Sizes   map[string]int64 `json:"sizes,omitempty"`
+}
+
+// The bucket index lists the keys of the buckets holding items, so that the
+// buckets can be enumerated without listing the underlying storage.
+//
+// The index is kept as a superset of the non-empty buckets: a key is added to
+// the index before a bucket holding items is first written under it, and is
+// removed only after the bucket has been emptied. An interrupted write can
+// therefore leave a stale key behind, pointing to an empty or missing bucket,
+// which readers skip, but never leaves out a bucket holding items. The index
+// is cached in memory after it is first loaded, which assumes that the packer
+// is the only writer of its view. If the index is missing it is rebuilt from a
+// listing of the storage.
+//
+// The index also records the stored size of each bucket. Sizes are updated in
+// memory on every write but only persisted along with changes to the set of
+// indexed buckets, so the persisted sizes may lag recent writes.
+
+// loadBucketIndexLocked loads the bucket index into memory, rebuilding it if
+// it was not persisted yet. The index lock must be held.
+func (s *StoragePacker) loadBucketIndexLocked(ctx context.Context) error {
+	if s.bucketIndex != nil {
+		return nil
+	}
+
+	entry, err := s.view.Get(ctx, s.viewPrefix+bucketIndexKey)
+	if err != nil {
+		return errwrap.Wrapf("failed to read bucket index: {{err}}", err)
+	}
+
+	index := make(map[string]int64)
+	if entry == nil {
+		keys, err := s.listBucketKeys(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			value, err := s.readBucketEntry(ctx, s.BucketPath(key))
+			if err != nil {
+				return errwrap.Wrapf("failed to read packed storage entry: {{err}}", err)
+			}
+			index[key] = int64(len(value))
+		}
+
+		s.bucketIndex = index
+		return s.persistBucketIndexLocked(ctx)
+	}
+
+	var indexEntry bucketIndexEntry
+	err = jsonutil.DecodeJSON(entry.Value, &indexEntry)
+	if err != nil {
+		return errwrap.Wrapf("failed to decode bucket index: {{err}}", err)
+	}
+	for _, key := range indexEntry.Buckets {
+		index[key] = indexEntry.Sizes[key]
+	}
+
+	s.bucketIndex = index
+	return nil
+}
+
+// persistBucketIndexLocked stores the in-memory bucket index. The index lock
+// must be held.
+func (s *StoragePacker) persistBucketIndexLocked(ctx context.Context) error {
+	indexEntry := &bucketIndexEntry{
+		Buckets: s.sortedBucketIndexLocked(),
+		Sizes:   s.bucketIndex,
+	}
+
+	value, err := jsonutil.EncodeJSON(indexEntry)
+	if err != nil {
+		return errwrap.Wrapf("failed to encode bucket index: {{err}}", err)
+	}
+
+	err = s.view.Put(ctx, &logical.StorageEntry{
+		Key:   s.viewPrefix + bucketIndexKey,
+		Value: value,
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to persist bucket index: {{err}}", err)
+	}
+
+	return nil
+}
+
+func (s *StoragePacker) sortedBucketIndexLocked() []string {
+	keys := make([]string, 0, len(s.bucketIndex))
+	for key := range s.bucketIndex {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indexedBucketKeys returns the keys of the buckets in the bucket index
+func (s *StoragePacker) indexedBucketKeys(ctx context.Context) ([]string, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	err := s.loadBucketIndexLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.sortedBucketIndexLocked(), nil
+}
+
+// updateBucketIndex adds the given bucket key to the bucket index along with
+// the size of the bucket, or removes it, persisting the index if the set of
+// indexed buckets changed.
+func (s *StoragePacker) updateBucketIndex(ctx context.Context, key string, present bool, size int64) error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	err := s.loadBucketIndexLocked(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, ok := s.bucketIndex[key]
+	switch {
+	case present && ok:
+		s.bucketIndex[key] = size
+		return nil
+	case present && !ok:
+		s.bucketIndex[key] = size
+	case !present && ok:
+		delete(s.bucketIndex, key)
+	default:
+		return nil
+	}
+
+	return s.persistBucketIndexLocked(ctx)
+}
+
+// clearBucketIndex deletes the persisted bucket index along with the
+// in-memory one, so that it gets rebuilt from storage on next use
+func (s *StoragePacker) clearBucketIndex(ctx context.Context) error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	s.bucketIndex = nil
+
+	err := s.view.Delete(ctx, s.viewPrefix+bucketIndexKey)
+	if err != nil {
+		return errwrap.Wrapf("failed to delete bucket index: {{err}}", err)
+	}
+
+	return nil
+}
+
+// resetBucketIndex drops the in-memory bucket index so that it gets reloaded
+// from storage on next use
+func (s *StoragePacker) resetBucketIndex() {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	s.bucketIndex = nil
+}
+
+// ApproximateTotalSize returns the approximate number of bytes occupied by the
+// buckets, summed from the sizes recorded in the bucket index without reading
+// the buckets. The result may lag recent writes by other processes, or made
+// before the packer was reopened. It requires Config.IndexBuckets.
+func (s *StoragePacker) ApproximateTotalSize(ctx context.Context) (int64, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if !s.config.IndexBuckets {
+		return 0, fmt.Errorf("bucket index is not enabled")
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	err := s.loadBucketIndexLocked(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, size := range s.bucketIndex {
+		total += size
+	}
+
+	return total, nil
+}
@@ -0,0 +1,114 @@
+package storagepacker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/hashicorp/errwrap"
+)
+
+// JSONItemTypeURL is the type URL of item payloads encoded by JSONItemCodec
+const JSONItemTypeURL = "storagepacker/json"
+
+// ItemCodec encodes values into item payloads and decodes them back. The
+// buckets themselves are always encoded using protobuf; the codec only
+// determines how the payload of each item is serialized.
+type ItemCodec interface {
+	Encode(v interface{}) (*any.Any, error)
+	Decode(payload *any.Any, out interface{}) error
+}
+
+// ProtoItemCodec encodes protobuf messages into item payloads. This is the
+// default codec.
+type ProtoItemCodec struct{}
+
+func (ProtoItemCodec) Encode(v interface{}) (*any.Any, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("value of type %T is not a protobuf message", v)
+	}
+
+	return ptypes.MarshalAny(msg)
+}
+
+func (ProtoItemCodec) Decode(payload *any.Any, out interface{}) error {
+	msg, ok := out.(proto.Message)
+	if !ok {
+		return fmt.Errorf("value of type %T is not a protobuf message", out)
+	}
+
+	return ptypes.UnmarshalAny(payload, msg)
+}
+
+// JSONItemCodec encodes arbitrary values into item payloads as JSON, avoiding
+// an additional protobuf encoding of data which is naturally JSON.
+type JSONItemCodec struct{}
+
+func (JSONItemCodec) Encode(v interface{}) (*any.Any, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &any.Any{
+		TypeUrl: JSONItemTypeURL,
+		Value:   value,
+	}, nil
+}
+
+func (JSONItemCodec) Decode(payload *any.Any, out interface{}) error {
+	if payload.TypeUrl != JSONItemTypeURL {
+		return fmt.Errorf("payload of type %q is not JSON encoded", payload.TypeUrl)
+	}
+
+	return json.Unmarshal(payload.Value, out)
+}
+
+// itemCodec returns the codec configured for the packer
+func (s *StoragePacker) itemCodec() ItemCodec {
+	return s.config.ItemCodec
+}
+
+// EncodeItem creates an item with the given ID, holding the given value
+// encoded by the configured item codec as its payload.
+func (s *StoragePacker) EncodeItem(id string, v interface{}) (*Item, error) {
+	if id == "" {
+		return nil, fmt.Errorf("missing item ID")
+	}
+
+	if v == nil {
+		return nil, fmt.Errorf("nil value")
+	}
+
+	payload, err := s.itemCodec().Encode(v)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to encode item payload: {{err}}", err)
+	}
+
+	return &Item{
+		ID:      id,
+		Message: payload,
+	}, nil
+}
+
+// DecodeItem decodes the payload of the given item into out, using the
+// configured item codec.
+func (s *StoragePacker) DecodeItem(item *Item, out interface{}) error {
+	if item == nil {
+		return fmt.Errorf("nil item")
+	}
+
+	if item.Message == nil {
+		return fmt.Errorf("item %q has no payload", item.ID)
+	}
+
+	err := s.itemCodec().Decode(item.Message, out)
+	if err != nil {
+		return errwrap.Wrapf("failed to decode item payload: {{err}}", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/hashicorp/errwrap"
+)
+
+// corruptBucketError is returned when a stored bucket can't be decoded
+type corruptBucketError struct {
+	err error
+}
+
+func (e *corruptBucketError) Error() string {
+	return e.err.Error()
+}
+
+// CorruptBucket describes a stored bucket which couldn't be decoded
+type CorruptBucket struct {
+	// Key is the storage key of the bucket
+	Key string
+
+	// Err is the error encountered decoding the bucket
+	Err error
+}
+
+// WalkItemsBestEffort calls fn for each item stored by the packer, skipping
+// the buckets which can't be decoded instead of aborting. The skipped buckets
+// are logged and returned, which allows salvaging the readable items of a
+// partially corrupt store. Errors reading the storage, or returned by fn,
+// still abort the walk.
+func (s *StoragePacker) WalkItemsBestEffort(ctx context.Context, fn func(*Item) error) ([]*CorruptBucket, error) {
+	var corrupt []*CorruptBucket
+	onCorrupt := func(key string, err error) {
+		s.logger.Warn("storagepacker: skipping corrupt bucket", "key", key, "error", err)
+		corrupt = append(corrupt, &CorruptBucket{
+			Key: key,
+			Err: err,
+		})
+	}
+
+	err := s.walkBucketsSkipping(ctx, onCorrupt, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return corrupt, err
+}
+
+// ValidateStore decodes a random sample of the stored buckets, the given
+// fraction of them rounded up, along with the timestamps of their items. It
+// returns an error naming the first bucket which fails to decode. This is
+// meant as a cheap check, e.g. on startup, that the stored data is still
+// compatible with the current schema; a sample of 1 checks every bucket.
+func (s *StoragePacker) ValidateStore(ctx context.Context, sample float64) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	if sample <= 0 || sample > 1 {
+		return fmt.Errorf("invalid sample %v, should be in (0, 1]", sample)
+	}
+
+	keys, err := s.listBucketKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	count := int(math.Ceil(sample * float64(len(keys))))
+	for _, i := range rand.Perm(len(keys))[:count] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bucketPath := s.BucketPath(keys[i])
+		if err := s.validateBucket(ctx, bucketPath); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("invalid bucket %q: {{err}}", bucketPath), err)
+		}
+	}
+
+	return nil
+}
+
+// validateBucket decodes the bucket stored at bucketPath and the timestamps
+// of its items
+func (s *StoragePacker) validateBucket(ctx context.Context, bucketPath string) error {
+	bucket, err := s.GetBucket(bucketPath)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	for _, item := range bucket.Items {
+		if item.ID == "" {
+			return fmt.Errorf("item without ID")
+		}
+		if item.LastUpdateTime != nil {
+			if _, err := ptypes.Timestamp(item.LastUpdateTime); err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("invalid last update time of item %q: {{err}}", item.ID), err)
+			}
+		}
+		if item.CreationTime != nil {
+			if _, err := ptypes.Timestamp(item.CreationTime); err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("invalid creation time of item %q: {{err}}", item.ID), err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package storagepacker
+
+import (
+	"fmt"
+	"math"
+)
+
+// DistReport describes how a set of items spreads across the buckets of a
+// storage packer
+type DistReport struct {
+	// Items is the number of items
+	Items int
+
+	// Counts holds the number of items placed in each bucket, by bucket
+	// index
+	Counts []int
+
+	// EmptyBuckets is the number of buckets holding no items
+	EmptyBuckets int
+
+	// Min and Max are the smallest and largest number of items placed in a
+	// single bucket
+	Min int
+	Max int
+
+	// Mean and StdDev are the mean and standard deviation of the number of
+	// items per bucket
+	Mean   float64
+	StdDev float64
+}
+
+// DistributionReport computes how the items with the given IDs would be
+// spread across the buckets, using the default hashing of the packer. It doesn't
+// access any storage, which allows validating the distribution of an ID
+// population before writing anything.
+func DistributionReport(itemIDs []string) (*DistReport, error) {
+	if len(itemIDs) == 0 {
+		return nil, fmt.Errorf("no item IDs given")
+	}
+
+	report := &DistReport{
+		Items:  len(itemIDs),
+		Counts: make([]int, bucketCount),
+	}
+
+	for _, itemID := range itemIDs {
+		report.Counts[itemBucketIndex(itemID)]++
+	}
+
+	report.Min = math.MaxInt32
+	for _, count := range report.Counts {
+		if count == 0 {
+			report.EmptyBuckets++
+		}
+		if count < report.Min {
+			report.Min = count
+		}
+		if count > report.Max {
+			report.Max = count
+		}
+	}
+
+	report.Mean = float64(report.Items) / float64(bucketCount)
+
+	var variance float64
+	for _, count := range report.Counts {
+		variance += math.Pow(float64(count)-report.Mean, 2)
+	}
+	report.StdDev = math.Sqrt(variance / float64(bucketCount))
+
+	return report, nil
+}
@@ -0,0 +1,130 @@
+package storagepacker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/errwrap"
+)
+
+// ManifestEntry describes an item stored by the packer without exposing its
+// payload
+type ManifestEntry struct {
+	// ID is the ID of the item
+	ID string `json:"id"`
+
+	// BucketKey is the key of the bucket holding the item
+	BucketKey string `json:"bucket_key"`
+
+	// Size is the marshaled size of the item in its bucket, in bytes, which
+	// for split items doesn't include their payload
+	Size int `json:"size"`
+}
+
+// ExportManifest writes a line per item stored by the packer to w, each
+// holding the JSON encoded ManifestEntry of the item. Payloads are never
+// written, which allows auditing the stored data without exposing it.
+func (s *StoragePacker) ExportManifest(ctx context.Context, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return s.walkBuckets(ctx, func(bucket *Bucket) error {
+		bucketKey := strings.TrimPrefix(bucket.Key, s.viewPrefix)
+		for _, item := range bucket.Items {
+			err := enc.Encode(&ManifestEntry{
+				ID:        item.ID,
+				BucketKey: bucketKey,
+				Size:      proto.Size(item),
+			})
+			if err != nil {
+				return errwrap.Wrapf("failed to write manifest entry: {{err}}", err)
+			}
+		}
+		return nil
+	})
+}
+
+// ItemSize is the marshaled size of an item
+type ItemSize struct {
+	ID   string
+	Size int64
+}
+
+// ListLargeItems returns the items whose marshaled size exceeds minSize,
+// largest first, to help find the items bloating their buckets. Every item
+// is marshaled to be measured, so this costs about as much as rewriting all
+// the buckets and is meant for diagnostics only.
+func (s *StoragePacker) ListLargeItems(ctx context.Context, minSize int64) ([]ItemSize, error) {
+	var large []ItemSize
+	err := s.walkBuckets(ctx, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			size := int64(proto.Size(item))
+			if size > minSize {
+				large = append(large, ItemSize{
+					ID:   item.ID,
+					Size: size,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(large, func(i, j int) bool {
+		if large[i].Size != large[j].Size {
+			return large[i].Size > large[j].Size
+		}
+		return large[i].ID < large[j].ID
+	})
+
+	return large, nil
+}
+
+// FindDuplicatePayloads returns the groups of items storing identical
+// payloads, keyed by the hex encoded SHA256 hash of their marshaled message.
+// Only groups of at least two items are returned, with sorted IDs. Items
+// without a message are ignored.
+func (s *StoragePacker) FindDuplicatePayloads(ctx context.Context) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	err := s.walkBuckets(ctx, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			item, err := s.loadPayload(ctx, item)
+			if err != nil {
+				return err
+			}
+			if item.Message == nil {
+				continue
+			}
+
+			payload, err := proto.Marshal(item.Message)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("failed to marshal payload of item %q: {{err}}", item.ID), err)
+			}
+
+			hash := sha256.Sum256(payload)
+			key := hex.EncodeToString(hash[:])
+			groups[key] = append(groups[key], item.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key, itemIDs := range groups {
+		if len(itemIDs) < 2 {
+			delete(groups, key)
+			continue
+		}
+		sort.Strings(itemIDs)
+	}
+
+	return groups, nil
+}
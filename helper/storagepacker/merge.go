@@ -0,0 +1,68 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/errwrap"
+)
+
+// MergeFrom copies the items stored by other into this packer. Items are
+// placed according to the bucketing of this packer, so both packers don't
+// need to share the same configuration. The IDs of the items existing in
+// both packers are returned, sorted; those are only replaced by the ones of
+// other if overwrite is set. other is only read from.
+func (s *StoragePacker) MergeFrom(ctx context.Context, other *StoragePacker, overwrite bool) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if other == nil {
+		return nil, fmt.Errorf("nil packer to merge from")
+	}
+	if other == s {
+		return nil, fmt.Errorf("cannot merge a packer into itself")
+	}
+
+	var conflicts []string
+	err := other.walkBuckets(ctx, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			item, err := other.loadPayload(ctx, item)
+			if err != nil {
+				return err
+			}
+
+			conflict := false
+			_, err = s.CompareAndSwapItem(ctx, item.ID, func(existing *Item) (bool, *Item) {
+				if existing != nil {
+					conflict = true
+					if !overwrite {
+						return false, nil
+					}
+				}
+				return true, proto.Clone(item).(*Item)
+			})
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("failed to merge item %q: {{err}}", item.ID), err)
+			}
+
+			if conflict {
+				conflicts = append(conflicts, item.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(conflicts)
+
+	return conflicts, nil
+}
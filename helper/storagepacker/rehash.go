@@ -0,0 +1,148 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/locksutil"
+)
+
+// RehashAll moves the items placed according to oldHash into the buckets
+// computed by the current configuration, and deletes the old buckets it
+// empties. A nil oldHash stands for the default placement. This is needed
+// after changing Config.PrimaryIndexFunc on existing data.
+//
+// RehashAll can be run again after an interruption: an item is copied to
+// its new bucket before being removed from its old one, and a copy already
+// present in the new bucket, from an earlier run or a later write, is kept.
+func (s *StoragePacker) RehashAll(ctx context.Context, oldHash HashFunc) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	if oldHash == nil {
+		oldHash = itemBucketIndex
+	}
+
+	keys, err := s.listBucketKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.rehashBucket(ctx, key, oldHash); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to rehash bucket %q: {{err}}", key), err)
+		}
+	}
+
+	return nil
+}
+
+// rehashBucket moves the items of the bucket with the given key which were
+// placed there by oldHash and belong elsewhere now
+func (s *StoragePacker) rehashBucket(ctx context.Context, key string, oldHash HashFunc) error {
+	bucketPath := s.BucketPath(key)
+
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.RLock()
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	moves := make(map[string][]*Item)
+	var movedIDs []string
+	for _, item := range bucket.Items {
+		if strconv.Itoa(int(oldHash(item.ID))) != key {
+			continue
+		}
+
+		newPath := s.BucketPath(s.BucketKey(item.ID))
+		if newPath == bucketPath {
+			continue
+		}
+
+		moves[newPath] = append(moves[newPath], item)
+		movedIDs = append(movedIDs, item.ID)
+	}
+	if len(moves) == 0 {
+		return nil
+	}
+
+	newPaths := make([]string, 0, len(moves))
+	for newPath := range moves {
+		newPaths = append(newPaths, newPath)
+	}
+	sort.Strings(newPaths)
+
+	for _, newPath := range newPaths {
+		if err := s.insertMissingItems(ctx, newPath, moves[newPath]); err != nil {
+			return err
+		}
+	}
+
+	lock.Lock()
+	bucket, err = s.decodeBucket(ctx, bucketPath)
+	if err == nil && bucket != nil {
+		for _, itemID := range movedIDs {
+			bucket.remove(itemID)
+		}
+		err = s.putBucket(ctx, bucket, bucket.Version)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.removeBucketIfEmpty(ctx, bucketPath)
+	return err
+}
+
+// insertMissingItems adds to the bucket stored at bucketPath the given items
+// it doesn't already hold. The items are moved as is, keeping their
+// timestamps.
+func (s *StoragePacker) insertMissingItems(ctx context.Context, bucketPath string, items []*Item) error {
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		bucket = &Bucket{
+			Key: bucketPath,
+		}
+	}
+
+	modified := false
+	for _, item := range items {
+		if bucket.findItem(item.ID) != nil {
+			continue
+		}
+		if err := s.checkBucketCapacity(bucket, nil); err != nil {
+			return err
+		}
+		if err := bucket.upsert(item); err != nil {
+			return err
+		}
+		modified = true
+	}
+	if !modified {
+		return nil
+	}
+
+	return s.putBucket(ctx, bucket, bucket.Version)
+}
@@ -0,0 +1,180 @@
+package storagepacker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/locksutil"
+)
+
+// primarySnapshot is the serialized form of a bucket written by
+// ExportPrimary
+type primarySnapshot struct {
+	// BucketKey is the key of the exported bucket, without the view prefix
+	BucketKey string `json:"bucket_key"`
+
+	// Bucket is the marshaled bucket
+	Bucket []byte `json:"bucket"`
+}
+
+// ExportPrimary writes a snapshot of the bucket with the given key, i.e. the
+// decimal bucket index, to w. Nothing is written for a bucket which doesn't
+// exist. This allows backing up the items of a single bucket, e.g. those of
+// a tenant whose IDs share it, which ImportPrimary restores. Split items are
+// written whole, along with their payload.
+func (s *StoragePacker) ExportPrimary(ctx context.Context, bucketKey string, w io.Writer) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	index, err := strconv.Atoi(bucketKey)
+	if err != nil || index < 0 || index >= bucketCount || strconv.Itoa(index) != bucketKey {
+		return fmt.Errorf("invalid bucket key %q", bucketKey)
+	}
+
+	bucketPath := s.BucketPath(bucketKey)
+
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.RLock()
+	bucket, err := s.wholeBucket(ctx, bucketPath)
+	lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	marshaledBucket, err := proto.Marshal(bucket)
+	if err != nil {
+		return errwrap.Wrapf("failed to marshal bucket: {{err}}", err)
+	}
+
+	err = json.NewEncoder(w).Encode(&primarySnapshot{
+		BucketKey: bucketKey,
+		Bucket:    marshaledBucket,
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to write bucket snapshot: {{err}}", err)
+	}
+
+	return nil
+}
+
+// ImportPrimary restores the snapshots written by ExportPrimary read from r.
+// The items replace those with the same IDs and keep their timestamps. They
+// are placed according to the configuration of this packer, which may
+// differ from the one of the exporting packer. Items which were split are
+// restored whole.
+func (s *StoragePacker) ImportPrimary(ctx context.Context, r io.Reader) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var snapshot primarySnapshot
+		err := dec.Decode(&snapshot)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errwrap.Wrapf("failed to read bucket snapshot: {{err}}", err)
+		}
+
+		var bucket Bucket
+		if err := proto.Unmarshal(snapshot.Bucket, &bucket); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to unmarshal snapshot of bucket %q: {{err}}", snapshot.BucketKey), err)
+		}
+
+		items := make(map[string][]*Item)
+		for _, item := range bucket.Items {
+			item, _, err := wholeItem(item)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("invalid snapshot of bucket %q: {{err}}", snapshot.BucketKey), err)
+			}
+
+			bucketPath := s.BucketPath(s.BucketKey(item.ID))
+			items[bucketPath] = append(items[bucketPath], item)
+		}
+
+		bucketPaths := make([]string, 0, len(items))
+		for bucketPath := range items {
+			bucketPaths = append(bucketPaths, bucketPath)
+		}
+		sort.Strings(bucketPaths)
+
+		for _, bucketPath := range bucketPaths {
+			if err := s.restoreItems(ctx, bucketPath, items[bucketPath]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// wholeBucket returns the bucket stored at bucketPath, or nil if it doesn't
+// exist, with the payloads of its split items loaded into them. Callers are
+// expected to hold the lock for the key.
+func (s *StoragePacker) wholeBucket(ctx context.Context, bucketPath string) (*Bucket, error) {
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil || bucket == nil {
+		return nil, err
+	}
+
+	for i, item := range bucket.Items {
+		item, err := s.loadPayload(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+
+		bucket.Items[i], _, err = wholeItem(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bucket, nil
+}
+
+// restoreItems stores the given items as is in the bucket stored at
+// bucketPath, replacing the items with the same IDs
+func (s *StoragePacker) restoreItems(ctx context.Context, bucketPath string, items []*Item) error {
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return err
+	}
+	if bucket == nil {
+		bucket = &Bucket{
+			Key: bucketPath,
+		}
+	}
+
+	payloadKeys := bucket.payloadKeys()
+
+	for _, item := range items {
+		if err := s.checkBucketCapacity(bucket, bucket.findItem(item.ID)); err != nil {
+			return err
+		}
+		if err := bucket.upsert(item); err != nil {
+			return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+		}
+	}
+
+	if err := s.putBucket(ctx, bucket, bucket.Version); err != nil {
+		return err
+	}
+
+	s.releasePayloads(ctx, bucket, payloadKeys)
+
+	return nil
+}
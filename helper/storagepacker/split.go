@@ -0,0 +1,183 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/hashicorp/errwrap"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// payloadsPrefix is the prefix, relative to the view prefix, under which the
+// payloads of split items are stored. Keys starting with an underscore are
+// reserved by the packer.
+const payloadsPrefix = "_payloads/"
+
+// Split items keep their header, i.e. their ID, their timestamps and the key
+// of their payload, in their bucket, while their payload is stored in a
+// storage entry of its own. Reading the header with GetItemHeader then
+// doesn't read the payload, which saves reading and decompressing large
+// payloads along with the bucket for callers only interested in the header,
+// at the cost of an extra read in GetItem.
+//
+// Items are split when stored by PutItemWithOptions with
+// PutItemOptions.SplitPayload set; the other writes store them whole. Each
+// write of a split item stores its payload under a new key, before the
+// bucket, and the payload it replaces is deleted once the bucket no longer
+// refers to it. An interrupted write therefore never leaves a header
+// pointing to a missing payload, but may leave behind a payload nothing
+// refers to, which PurgeAll removes. Payload writes are mirrored to the
+// secondary view along with the buckets, but like bucket deletions, payload
+// deletions are not.
+
+// splitItem returns the header to store in the bucket in place of item, and
+// the payload to store under the key recorded in the header. Items without a
+// payload are not split.
+func splitItem(item *Item) (*Item, *any.Any, error) {
+	if item.Message == nil {
+		return wholeItem(item)
+	}
+
+	key, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("failed to generate payload key: {{err}}", err)
+	}
+
+	header := *item
+	header.Message = nil
+	header.PayloadKey = payloadsPrefix + key
+
+	return &header, item.Message, nil
+}
+
+// wholeItem returns the item to store in the bucket in place of item when
+// it isn't split, which is a copy without a payload key if item was split.
+// The header of a split item can't be stored whole, since it has no payload.
+func wholeItem(item *Item) (*Item, *any.Any, error) {
+	if item.PayloadKey == "" {
+		return item, nil, nil
+	}
+
+	if item.Message == nil {
+		return nil, nil, fmt.Errorf("item %q is the header of a split item, without its payload", item.ID)
+	}
+
+	whole := *item
+	whole.PayloadKey = ""
+
+	return &whole, nil, nil
+}
+
+// payloadKeys returns the payload keys of the split items of the bucket, by
+// item ID
+func (s *Bucket) payloadKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, item := range s.GetItems() {
+		if item.PayloadKey != "" {
+			keys[item.ID] = item.PayloadKey
+		}
+	}
+
+	return keys
+}
+
+// putPayload stores the payload of a split item under the given key. Like
+// buckets, payloads are split across multiple storage entries if they are
+// too large, and mirrored to the secondary view if any. The payload is
+// queued for mirroring before the bucket referring to it.
+func (s *StoragePacker) putPayload(ctx context.Context, key string, payload *any.Any) error {
+	value, err := proto.Marshal(payload)
+	if err != nil {
+		return errwrap.Wrapf("failed to marshal item payload: {{err}}", err)
+	}
+
+	err = s.writeBucketEntry(ctx, s.viewPrefix+key, value)
+	if err != nil {
+		return errwrap.Wrapf("failed to persist item payload: {{err}}", err)
+	}
+
+	s.mirrorBucketEntry(s.viewPrefix+key, value)
+
+	return nil
+}
+
+// loadPayload returns item with its payload if it is split, and item itself
+// otherwise. Callers are expected to hold the lock for the bucket of the
+// item, so that the payload isn't replaced meanwhile.
+func (s *StoragePacker) loadPayload(ctx context.Context, item *Item) (*Item, error) {
+	if item == nil || item.PayloadKey == "" {
+		return item, nil
+	}
+
+	value, err := s.readBucketEntry(ctx, s.viewPrefix+item.PayloadKey)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read item payload: {{err}}", err)
+	}
+	if value == nil {
+		return nil, fmt.Errorf("missing payload of item %q", item.ID)
+	}
+
+	var payload any.Any
+	err = proto.Unmarshal(value, &payload)
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to unmarshal payload of item %q: {{err}}", item.ID), err)
+	}
+
+	loaded := *item
+	loaded.Message = &payload
+
+	return &loaded, nil
+}
+
+// releasePayloads deletes the payloads of the given payload keys, taken from
+// the bucket before it was written, that the written bucket no longer refers
+// to. A payload which can't be deleted is only left behind, since the write
+// already happened.
+func (s *StoragePacker) releasePayloads(ctx context.Context, bucket *Bucket, payloadKeys map[string]string) {
+	for itemID, key := range payloadKeys {
+		if item := bucket.findItem(itemID); item != nil && item.PayloadKey == key {
+			continue
+		}
+
+		s.deletePayload(ctx, key)
+	}
+}
+
+// deletePayload deletes the payload stored under the given key, logging a
+// failure to do so
+func (s *StoragePacker) deletePayload(ctx context.Context, key string) {
+	err := s.deleteBucketEntry(ctx, s.viewPrefix+key)
+	if err != nil {
+		s.logger.Warn("storagepacker: failed to delete item payload", "key", key, "error", err)
+	}
+}
+
+// purgePayloads deletes the payloads of all the split items
+func (s *StoragePacker) purgePayloads(ctx context.Context) error {
+	keys, err := s.view.List(ctx, s.viewPrefix+payloadsPrefix)
+	if err != nil {
+		return errwrap.Wrapf("failed to list item payloads: {{err}}", err)
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err = s.view.Delete(ctx, s.viewPrefix+payloadsPrefix+key)
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("failed to delete item payload %q: {{err}}", key), err)
+		}
+	}
+
+	return nil
+}
+
+// GetItemHeader returns the item with the given ID like GetItem, but without
+// the payload of a split item, which isn't read. Items which aren't split
+// are returned whole.
+func (s *StoragePacker) GetItemHeader(itemID string) (*Item, error) {
+	return s.getItem(itemID, false)
+}
@@ -0,0 +1,99 @@
+package storagepacker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/hashicorp/vault/logical"
+)
+
+// RawItemTypeURL is the type URL of the item payloads holding the raw values
+// of the storage entries written through AsStorage
+const RawItemTypeURL = "storagepacker/raw"
+
+// packerStorage is the logical.Storage returned by AsStorage
+type packerStorage struct {
+	packer *StoragePacker
+}
+
+// AsStorage returns a logical.Storage storing its entries as items of the
+// packer, so that components written against logical.Storage can benefit
+// from the packing. The mapping is as follows:
+//
+// * The key of an entry is the ID of its item, and its value is the payload
+//   of the item, with the RawItemTypeURL type URL. SealWrap is not
+//   preserved.
+// * Get fails on items whose payload wasn't written through the adapter.
+// * List lists the item IDs, like any logical.Storage: the keys directly
+//   under the prefix, and the distinct "folders" holding deeper keys, with
+//   a trailing slash. It walks every bucket.
+func (s *StoragePacker) AsStorage() logical.Storage {
+	return &packerStorage{
+		packer: s,
+	}
+}
+
+func (p *packerStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	itemIDs, err := p.packer.ListItemIDsWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	keys := []string{}
+	for _, itemID := range itemIDs {
+		key := strings.TrimPrefix(itemID, prefix)
+		if i := strings.Index(key, "/"); i != -1 {
+			key = key[:i+1]
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (p *packerStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	item, err := p.packer.GetItem(key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+
+	if item.Message == nil || item.Message.TypeUrl != RawItemTypeURL {
+		return nil, fmt.Errorf("item %q doesn't hold a raw value", key)
+	}
+
+	return &logical.StorageEntry{
+		Key:   key,
+		Value: item.Message.Value,
+	}, nil
+}
+
+func (p *packerStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if entry == nil {
+		return fmt.Errorf("nil storage entry")
+	}
+
+	return p.packer.PutItemWithOptions(ctx, &Item{
+		ID: entry.Key,
+		Message: &any.Any{
+			TypeUrl: RawItemTypeURL,
+			Value:   entry.Value,
+		},
+	}, nil)
+}
+
+func (p *packerStorage) Delete(ctx context.Context, key string) error {
+	_, err := p.packer.DeleteItemExisted(ctx, key)
+	return err
+}
@@ -0,0 +1,62 @@
+package storagepacker
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// StorageClassHinter is implemented by views able to place entries
+// according to a storage class, e.g. tiered backends keeping hot and cold
+// data apart. Views which don't implement it get no hints.
+type StorageClassHinter interface {
+	PutWithStorageClass(ctx context.Context, entry *logical.StorageEntry, storageClass string) error
+}
+
+// PutItemOptions holds the options of PutItemWithOptions
+type PutItemOptions struct {
+	// StorageClass is passed to the view along with the bucket holding the
+	// item if the view implements StorageClassHinter, and ignored otherwise.
+	// As items share buckets, the hint applies to the whole bucket until it
+	// is written again.
+	StorageClass string
+
+	// SplitPayload stores the payload of the item in a storage entry of its
+	// own rather than in its bucket, so that GetItemHeader can read the item
+	// without its payload. The hint of StorageClass applies to the payload
+	// too.
+	SplitPayload bool
+}
+
+// storageClassKey is the context key under which the storage class hint of a
+// write is kept
+type storageClassKey struct{}
+
+// PutItemWithOptions stores an item like PutItem, applying the given options
+// to the write
+func (s *StoragePacker) PutItemWithOptions(ctx context.Context, item *Item, opts *PutItemOptions) error {
+	if opts != nil && opts.StorageClass != "" {
+		ctx = context.WithValue(ctx, storageClassKey{}, opts.StorageClass)
+	}
+
+	return s.putItem(ctx, item, opts != nil && opts.SplitPayload)
+}
+
+// putEntry writes entry to view, passing along the storage class hint held
+// by ctx if the view supports it
+func (s *StoragePacker) putEntry(ctx context.Context, view logical.Storage, entry *logical.StorageEntry) error {
+	storageClass, _ := ctx.Value(storageClassKey{}).(string)
+	if storageClass == "" {
+		return view.Put(ctx, entry)
+	}
+
+	hinter, ok := view.(StorageClassHinter)
+	if !ok {
+		if s.logger.IsDebug() {
+			s.logger.Debug("storagepacker: view doesn't support storage class hints, ignoring hint", "key", entry.Key, "storage_class", storageClass)
+		}
+		return view.Put(ctx, entry)
+	}
+
+	return hinter.PutWithStorageClass(ctx, entry, storageClass)
+}
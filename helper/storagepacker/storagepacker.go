@@ -3,14 +3,24 @@ package storagepacker
 import (
 	"context"
 	"crypto/md5"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
 	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/helper/compressutil"
+	"github.com/hashicorp/vault/helper/jsonutil"
 	"github.com/hashicorp/vault/helper/locksutil"
 	"github.com/hashicorp/vault/logical"
 	log "github.com/mgutz/logxi/v1"
@@ -19,8 +29,152 @@ import (
 const (
 	bucketCount                = 256
 	StoragePackerBucketsPrefix = "packer/buckets/"
+
+	// bucketPartsCanary is the first byte of a bucket storage entry whose
+	// value was split across multiple storage entries. It is followed by the
+	// uvarint encoded number of parts and then the first part of the value.
+	bucketPartsCanary byte = 'M'
+
+	// removedBucketsPrefix is the prefix, relative to the view prefix, under
+	// which the versions of the buckets removed by Compact are stored. Keys
+	// starting with an underscore are reserved by the packer.
+	removedBucketsPrefix = "_removed/"
+
+	// mirrorQueueSize is the number of bucket writes which can be queued for
+	// mirroring to the secondary view before further writes are dropped
+	mirrorQueueSize = 1024
+
+	// minStorageValueSize is the smallest allowed value for
+	// Config.MaxStorageValueSize; it leaves room for the multi-part header
+	// plus some data in the first part.
+	minStorageValueSize = 32
 )
 
+// ErrClosed is returned by the operations of a storage packer which has been
+// closed
+var ErrClosed = errors.New("storage packer is closed")
+
+// ErrItemIDTooLong is returned by the item operations of a storage packer
+// when the item ID is longer than Config.MaxItemIDLength
+var ErrItemIDTooLong = errors.New("item ID is too long")
+
+// ErrPrimaryBucketFull is returned when inserting an item into a bucket
+// already holding Config.MaxItemsPerPrimary items
+var ErrPrimaryBucketFull = errors.New("bucket is full")
+
+// BucketVersionConflictError is returned by PutBucketCAS when the stored
+// bucket was modified since it was read
+type BucketVersionConflictError struct {
+	Key      string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *BucketVersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on bucket %q: expected version %d, found %d", e.Key, e.Expected, e.Actual)
+}
+
+// HashFunc returns the index of the bucket holding the item with the given
+// ID
+type HashFunc func(itemID string) uint8
+
+// Config is used to configure a storage packer
+type Config struct {
+	// View is the storage to be used by the packer
+	View logical.Storage
+
+	// ViewPrefix is the prefix under which the buckets are stored. Defaults
+	// to StoragePackerBucketsPrefix.
+	ViewPrefix string
+
+	// Logger is the logger used by the packer
+	Logger log.Logger
+
+	// MaxStorageValueSize, when non-zero, is the largest value the packer
+	// writes into a single storage entry. A bucket whose stored value is
+	// larger is split across the bucket key and additional "<key>.part1",
+	// "<key>.part2", ... entries, and reassembled on read. This is a safety
+	// valve for backends which cap the size of a single value.
+	MaxStorageValueSize int
+
+	// IndexBuckets makes the packer maintain an index of the buckets holding
+	// items, which is used to enumerate the buckets instead of listing the
+	// underlying storage.
+	IndexBuckets bool
+
+	// ItemCodec is used by EncodeItem and DecodeItem to serialize the
+	// payloads of items. Defaults to ProtoItemCodec.
+	ItemCodec ItemCodec
+
+	// StrictKeyValidation makes PutBucket verify that the key of the bucket
+	// is a valid bucket key and that all of its items hash to it, refusing
+	// to write misplaced buckets rather than failing on later reads.
+	StrictKeyValidation bool
+
+	// ItemGrowthThreshold, when non-zero, is the number of bytes by which
+	// the marshaled size of an item may grow in a single update before a
+	// warning is logged and the "storagepacker.item_growth" counter is
+	// incremented, to catch runaway item growth. The counter is labelled
+	// with the view prefix of the packer.
+	ItemGrowthThreshold int
+
+	// TrackTimestamps makes the packer stamp the stored items with their last
+	// update time and their creation time, which is preserved when they are
+	// updated. The items passed in by callers are left untouched.
+	TrackTimestamps bool
+
+	// PrimaryIndexFunc, when set, overrides the function placing items in
+	// buckets, which by default uses the first byte of the MD5 hash of their
+	// ID. It is used wherever the bucket of an item is computed. This is
+	// mostly meant for tests forcing items into given buckets; changing it
+	// on existing data makes the stored items unreachable.
+	PrimaryIndexFunc HashFunc
+
+	// MaxItemsPerPrimary, when non-zero, is the maximum number of items a
+	// bucket can hold. Inserting a new item into a full bucket fails with
+	// ErrPrimaryBucketFull, while existing items can still be updated. This
+	// guards against a skewed ID distribution piling up many small items in
+	// a single bucket.
+	MaxItemsPerPrimary int
+
+	// MaxItemIDLength, when non-zero, is the maximum length of item IDs.
+	// Operations on longer IDs fail with ErrItemIDTooLong, rather than with
+	// whatever error the backend returns for an overly long key. Defaults to
+	// 0, meaning no limit.
+	MaxItemIDLength int
+
+	// ItemValidator, when set, is called with every item about to be stored
+	// by PutItem, PutItemWithOptions, CompareAndSwapItem or a write batch.
+	// The write is rejected with its error if it fails, before any storage
+	// is touched.
+	ItemValidator func(*Item) error
+
+	// CompressionMinSize is the size, in bytes, a marshaled bucket must
+	// exceed to be compressed. Smaller buckets are stored uncompressed,
+	// saving CPU for a negligible cost in space. Defaults to 0, meaning that
+	// all buckets are compressed.
+	CompressionMinSize int
+
+	// SecondaryView, when set, is a storage to which every bucket written by
+	// PutBucket, and the payload of every split item, is mirrored
+	// asynchronously, on a best-effort basis, e.g. to keep a standby region
+	// roughly in sync. Reads never use it. Failed or dropped mirror writes
+	// are logged and counted by the "storagepacker.mirror_failure" counter,
+	// but don't fail the write to View. Writes still queued when the packer
+	// is closed are mirrored before Close returns. Bucket and payload
+	// deletions are not mirrored.
+	SecondaryView logical.Storage
+
+	// RecordTombstones makes the packer record when items are deleted, in
+	// an index kept apart from the buckets, which is queried using
+	// GetDeletionTime.
+	RecordTombstones bool
+
+	// Clock returns the current time used to stamp items and tombstones.
+	// Defaults to time.Now.
+	Clock func() time.Time
+}
+
 // StoragePacker packs the objects into a specific number of buckets by hashing
 // its ID and indexing it. Currently this supports only 256 bucket entries and
 // hence relies on the first byte of the hash value for indexing. The items
@@ -31,6 +185,22 @@ type StoragePacker struct {
 	logger       log.Logger
 	storageLocks []*locksutil.LockEntry
 	viewPrefix   string
+	config       *Config
+
+	// indexLock protects bucketIndex, the in-memory copy of the bucket
+	// index, which is nil until loaded
+	indexLock   sync.Mutex
+	bucketIndex map[string]int64
+
+	// closeCh is closed when the packer is closed, which stops the
+	// background goroutines tracked by bgWG
+	closeLock sync.RWMutex
+	closed    bool
+	closeCh   chan struct{}
+	bgWG      sync.WaitGroup
+
+	// mirrorCh queues the bucket writes to mirror to the secondary view
+	mirrorCh chan *logical.StorageEntry
 }
 
 // BucketPath returns the storage entry key for a given bucket key
@@ -59,6 +229,10 @@ func (s *StoragePacker) View() logical.Storage {
 
 // Get returns a bucket for a given key
 func (s *StoragePacker) GetBucket(key string) (*Bucket, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
 	if key == "" {
 		return nil, fmt.Errorf("missing bucket key")
 	}
@@ -67,32 +241,104 @@ func (s *StoragePacker) GetBucket(key string) (*Bucket, error) {
 	lock.RLock()
 	defer lock.RUnlock()
 
+	return s.decodeBucket(context.Background(), key)
+}
+
+// decodeBucket reads and decodes the bucket stored under the given key. It
+// returns nil if the bucket doesn't exist. Callers are expected to hold the
+// lock for the key.
+func (s *StoragePacker) decodeBucket(ctx context.Context, key string) (*Bucket, error) {
 	// Read from the underlying view
-	storageEntry, err := s.view.Get(context.Background(), key)
+	value, err := s.readBucketEntry(ctx, key)
 	if err != nil {
 		return nil, errwrap.Wrapf("failed to read packed storage entry: {{err}}", err)
 	}
-	if storageEntry == nil {
+	if value == nil {
 		return nil, nil
 	}
 
-	uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+	uncompressedData, notCompressed, err := compressutil.Decompress(value)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to decompress packed storage entry: {{err}}", err)
+		return nil, &corruptBucketError{errwrap.Wrapf("failed to decompress packed storage entry: {{err}}", err)}
 	}
 	if notCompressed {
-		uncompressedData = storageEntry.Value
+		uncompressedData = value
 	}
 
 	var bucket Bucket
 	err = proto.Unmarshal(uncompressedData, &bucket)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)
+		return nil, &corruptBucketError{errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)}
 	}
 
 	return &bucket, nil
 }
 
+// NewItem creates an item with the given ID, holding the given message as its
+// payload.
+func NewItem(id string, msg proto.Message) (*Item, error) {
+	if id == "" {
+		return nil, fmt.Errorf("missing item ID")
+	}
+
+	if msg == nil {
+		return nil, fmt.Errorf("nil message")
+	}
+
+	marshaledMsg, err := ptypes.MarshalAny(msg)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to marshal item message: {{err}}", err)
+	}
+
+	return &Item{
+		ID:      id,
+		Message: marshaledMsg,
+	}, nil
+}
+
+// Decode unmarshals the payload of the item into the given message
+func (i *Item) Decode(out proto.Message) error {
+	if i == nil {
+		return fmt.Errorf("nil item")
+	}
+
+	if i.Message == nil {
+		return fmt.Errorf("item %q has no message", i.ID)
+	}
+
+	err := ptypes.UnmarshalAny(i.Message, out)
+	if err != nil {
+		return errwrap.Wrapf("failed to decode item message: {{err}}", err)
+	}
+
+	return nil
+}
+
+// findItem returns the item of the bucket with the given ID, or nil if there
+// is none
+func (s *Bucket) findItem(itemID string) *Item {
+	for _, item := range s.GetItems() {
+		if item.ID == itemID {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// remove removes the item with the given ID from the bucket, and returns
+// whether it was present
+func (s *Bucket) remove(itemID string) bool {
+	for itemIdx, item := range s.Items {
+		if item.ID == itemID {
+			s.Items = append(s.Items[:itemIdx], s.Items[itemIdx+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
 // upsert either inserts a new item into the bucket or updates an existing one
 // if an item with a matching key is already present.
 func (s *Bucket) upsert(item *Item) error {
@@ -130,8 +376,17 @@ func (s *Bucket) upsert(item *Item) error {
 
 // BucketIndex returns the bucket key index for a given storage key
 func (s *StoragePacker) BucketIndex(key string) uint8 {
+	if s.config.PrimaryIndexFunc != nil {
+		return s.config.PrimaryIndexFunc(key)
+	}
+	return itemBucketIndex(key)
+}
+
+// itemBucketIndex returns the index of the bucket holding the item with the
+// given ID
+func itemBucketIndex(itemID string) uint8 {
 	hf := md5.New()
-	hf.Write([]byte(key))
+	hf.Write([]byte(itemID))
 	return uint8(hf.Sum(nil)[0])
 }
 
@@ -140,12 +395,38 @@ func (s *StoragePacker) BucketKey(itemID string) string {
 	return strconv.Itoa(int(s.BucketIndex(itemID)))
 }
 
+// PrimaryBucketKey returns the storage entry key of the bucket holding the
+// item with the given ID, without accessing storage. Items sharing a bucket
+// also share its lock, so callers can group parallel work by this key to
+// avoid contention.
+func (s *StoragePacker) PrimaryBucketKey(itemID string) (string, error) {
+	if itemID == "" {
+		return "", fmt.Errorf("empty item ID")
+	}
+
+	return s.BucketPath(s.BucketKey(itemID)), nil
+}
+
 // DeleteItem removes the storage entry which the given key refers to from its
 // corresponding bucket.
 func (s *StoragePacker) DeleteItem(itemID string) error {
+	_, err := s.DeleteItemExisted(context.Background(), itemID)
+	return err
+}
+
+// DeleteItemExisted removes the item with the given ID like DeleteItem, and
+// returns whether the item existed
+func (s *StoragePacker) DeleteItemExisted(ctx context.Context, itemID string) (bool, error) {
+	if err := s.checkClosed(); err != nil {
+		return false, err
+	}
 
 	if itemID == "" {
-		return fmt.Errorf("empty item ID")
+		return false, fmt.Errorf("empty item ID")
+	}
+
+	if err := s.checkItemIDLength(itemID); err != nil {
+		return false, err
 	}
 
 	// Get the bucket key
@@ -154,55 +435,101 @@ func (s *StoragePacker) DeleteItem(itemID string) error {
 	// Prepend the view prefix
 	bucketPath := s.BucketPath(bucketKey)
 
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
 	// Read from underlying view
-	storageEntry, err := s.view.Get(context.Background(), bucketPath)
+	bucket, err := s.decodeBucket(ctx, bucketPath)
 	if err != nil {
-		return errwrap.Wrapf("failed to read packed storage value: {{err}}", err)
+		return false, err
 	}
-	if storageEntry == nil {
-		return nil
+	if bucket == nil {
+		return false, nil
+	}
+
+	payloadKeys := bucket.payloadKeys()
+
+	// If there is a match, remove it from the collection and persist the
+	// resulting collection
+	if !bucket.remove(itemID) {
+		return false, nil
 	}
 
-	uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+	// Persist bucket entry only if there is an update
+	err = s.putBucketRemovingItems(ctx, bucket, bucket.Version, []string{itemID})
 	if err != nil {
-		return errwrap.Wrapf("failed to decompress packed storage value: {{err}}", err)
+		return false, err
 	}
-	if notCompressed {
-		uncompressedData = storageEntry.Value
+
+	s.releasePayloads(ctx, bucket, payloadKeys)
+
+	return true, nil
+}
+
+// Put stores a packed bucket entry
+func (s *StoragePacker) PutBucket(bucket *Bucket) error {
+	if err := s.checkClosed(); err != nil {
+		return err
 	}
 
-	var bucket Bucket
-	err = proto.Unmarshal(uncompressedData, &bucket)
+	if bucket == nil {
+		return fmt.Errorf("nil bucket entry")
+	}
+
+	if bucket.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+
+	lock := locksutil.LockForKey(s.storageLocks, bucket.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Every write bumps the version of the stored bucket, regardless of the
+	// version the caller's copy was read at
+	version, err := s.storedBucketVersion(context.Background(), bucket.Key)
 	if err != nil {
-		return errwrap.Wrapf("failed decoding packed storage entry: {{err}}", err)
+		return err
 	}
 
-	// Look for a matching storage entry
-	foundIdx := -1
-	for itemIdx, item := range bucket.Items {
-		if item.ID == itemID {
-			foundIdx = itemIdx
-			break
-		}
+	return s.putBucket(context.Background(), bucket, version)
+}
+
+// putBucket is PutBucket using the given context for storage operations.
+// storedVersion is the version of the bucket currently stored, as read by the
+// caller. Callers are expected to hold the lock for the key of the bucket.
+func (s *StoragePacker) putBucket(ctx context.Context, bucket *Bucket, storedVersion uint64) error {
+	if err := s.checkClosed(); err != nil {
+		return err
 	}
 
-	// If there is a match, remove it from the collection and persist the
-	// resulting collection
-	if foundIdx != -1 {
-		bucket.Items = append(bucket.Items[:foundIdx], bucket.Items[foundIdx+1:]...)
+	if bucket == nil {
+		return fmt.Errorf("nil bucket entry")
+	}
 
-		// Persist bucket entry only if there is an update
-		err = s.PutBucket(&bucket)
-		if err != nil {
+	if bucket.Key == "" {
+		return fmt.Errorf("missing key")
+	}
+
+	if !strings.HasPrefix(bucket.Key, s.viewPrefix) {
+		return fmt.Errorf("incorrect prefix; bucket entry key should have %q prefix", s.viewPrefix)
+	}
+
+	if s.config.StrictKeyValidation {
+		if err := s.validateBucketKey(bucket); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return s.putBucketUnchecked(ctx, bucket, storedVersion)
 }
 
-// Put stores a packed bucket entry
-func (s *StoragePacker) PutBucket(bucket *Bucket) error {
+// putBucketUnchecked stores a packed bucket entry without requiring its key
+// to be under the view prefix, so that internal relocations can stage
+// buckets under another prefix. Buckets outside of the view prefix are
+// neither indexed nor mirrored. Callers are expected to hold the lock for the
+// key of the bucket.
+func (s *StoragePacker) putBucketUnchecked(ctx context.Context, bucket *Bucket, storedVersion uint64) error {
 	if bucket == nil {
 		return fmt.Errorf("nil bucket entry")
 	}
@@ -211,145 +538,1200 @@ func (s *StoragePacker) PutBucket(bucket *Bucket) error {
 		return fmt.Errorf("missing key")
 	}
 
-	if !strings.HasPrefix(bucket.Key, s.viewPrefix) {
-		return fmt.Errorf("incorrect prefix; bucket entry key should have %q prefix", s.viewPrefix)
+	inView := strings.HasPrefix(bucket.Key, s.viewPrefix)
+
+	// A bucket which isn't stored may have been removed by Compact, in which
+	// case its versions carry on from the one it was removed at
+	var err error
+	if storedVersion == 0 && inView {
+		storedVersion, err = s.removedBucketVersion(ctx, bucket.Key)
+		if err != nil {
+			return err
+		}
 	}
 
-	marshaledBucket, err := proto.Marshal(bucket)
+	// The caller's bucket is only updated once the write has succeeded
+	stored := *bucket
+	stored.Version = storedVersion + 1
+
+	marshaledBucket, err := proto.Marshal(&stored)
 	if err != nil {
 		return errwrap.Wrapf("failed to marshal bucket: {{err}}", err)
 	}
 
-	compressedBucket, err := compressutil.Compress(marshaledBucket, &compressutil.CompressionConfig{
-		Type: compressutil.CompressionTypeSnappy,
-	})
-	if err != nil {
-		return errwrap.Wrapf("failed to compress packed bucket: {{err}}", err)
+	// Small buckets are stored uncompressed if configured. These are told
+	// apart on read as they lack the compression canary.
+	compressedBucket := marshaledBucket
+	if len(marshaledBucket) > s.config.CompressionMinSize {
+		compressedBucket, err = compressutil.Compress(marshaledBucket, &compressutil.CompressionConfig{
+			Type: compressutil.CompressionTypeSnappy,
+		})
+		if err != nil {
+			return errwrap.Wrapf("failed to compress packed bucket: {{err}}", err)
+		}
+	}
+
+	// A bucket holding items is added to the index before it is written
+	indexKey := strings.TrimPrefix(bucket.Key, s.viewPrefix)
+	if inView && s.config.IndexBuckets && len(bucket.Items) != 0 {
+		err = s.updateBucketIndex(ctx, indexKey, true, int64(len(compressedBucket)))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Store the compressed value
-	err = s.view.Put(context.Background(), &logical.StorageEntry{
-		Key:   bucket.Key,
-		Value: compressedBucket,
-	})
+	err = s.writeBucketEntry(ctx, bucket.Key, compressedBucket)
 	if err != nil {
 		return errwrap.Wrapf("failed to persist packed storage entry: {{err}}", err)
 	}
+	bucket.Version = stored.Version
 
-	return nil
-}
+	if inView {
+		s.mirrorBucketEntry(bucket.Key, compressedBucket)
+	}
 
-// GetItem fetches the storage entry for a given key from its corresponding
-// bucket.
-func (s *StoragePacker) GetItem(itemID string) (*Item, error) {
-	if itemID == "" {
-		return nil, fmt.Errorf("empty item ID")
+	// An emptied bucket is removed from the index after it is written
+	if inView && s.config.IndexBuckets && len(bucket.Items) == 0 {
+		err = s.updateBucketIndex(ctx, indexKey, false, 0)
+		if err != nil {
+			return err
+		}
 	}
 
-	bucketKey := s.BucketKey(itemID)
-	bucketPath := s.BucketPath(bucketKey)
+	return nil
+}
 
-	// Fetch the bucket entry
-	bucket, err := s.GetBucket(bucketPath)
+// storedBucketVersion returns the version of the bucket stored under the
+// given key, which is 0 if it doesn't exist. A corrupt bucket is being
+// overwritten, so its version is taken to be 0 as well. Callers are expected
+// to hold the lock for the key.
+func (s *StoragePacker) storedBucketVersion(ctx context.Context, key string) (uint64, error) {
+	current, err := s.decodeBucket(ctx, key)
 	if err != nil {
-		return nil, errwrap.Wrapf("failed to read packed storage item: {{err}}", err)
+		if _, ok := err.(*corruptBucketError); ok {
+			return 0, nil
+		}
+		return 0, err
 	}
-	if bucket == nil {
-		return nil, nil
+
+	return current.GetVersion(), nil
+}
+
+// validateBucketKey checks that the key of the bucket is one the packer
+// computes, and that every item of the bucket belongs to it
+func (s *StoragePacker) validateBucketKey(bucket *Bucket) error {
+	key := strings.TrimPrefix(bucket.Key, s.viewPrefix)
+
+	index, err := strconv.Atoi(key)
+	if err != nil || index < 0 || index >= bucketCount || strconv.Itoa(index) != key {
+		return fmt.Errorf("invalid bucket key %q", bucket.Key)
 	}
 
-	// Look for a matching storage entry in the bucket items
 	for _, item := range bucket.Items {
-		if item.ID == itemID {
-			return item, nil
+		if itemKey := s.BucketKey(item.ID); itemKey != key {
+			return fmt.Errorf("item %q belongs to bucket %q, not %q", item.ID, s.BucketPath(itemKey), bucket.Key)
 		}
 	}
 
-	return nil, nil
+	return nil
 }
 
-// PutItem stores a storage entry in its corresponding bucket
-func (s *StoragePacker) PutItem(item *Item) error {
-	if item == nil {
-		return fmt.Errorf("nil item")
+// PutBucketCAS stores the bucket only if the version of the stored bucket is
+// still expectedVersion, which is the version of the bucket when it was read;
+// a bucket which doesn't exist yet has version 0. Otherwise a
+// *BucketVersionConflictError is returned and nothing is written. This allows
+// tools to read-modify-write whole buckets without losing concurrent updates.
+func (s *StoragePacker) PutBucketCAS(bucket *Bucket, expectedVersion uint64) error {
+	if err := s.checkClosed(); err != nil {
+		return err
 	}
 
-	if item.ID == "" {
-		return fmt.Errorf("missing ID in item")
+	if bucket == nil {
+		return fmt.Errorf("nil bucket entry")
 	}
 
-	var err error
-	bucketKey := s.BucketKey(item.ID)
-	bucketPath := s.BucketPath(bucketKey)
-
-	bucket := &Bucket{
-		Key: bucketPath,
+	if bucket.Key == "" {
+		return fmt.Errorf("missing key")
 	}
 
-	// In this case, we persist the storage entry regardless of the read
-	// storageEntry below is nil or not. Hence, directly acquire write lock
-	// even to read the entry.
-	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock := locksutil.LockForKey(s.storageLocks, bucket.Key)
 	lock.Lock()
 	defer lock.Unlock()
 
-	// Check if there is an existing bucket for a given key
-	storageEntry, err := s.view.Get(context.Background(), bucketPath)
+	current, err := s.decodeBucket(context.Background(), bucket.Key)
 	if err != nil {
-		return errwrap.Wrapf("failed to read packed storage bucket entry: {{err}}", err)
+		return err
 	}
 
-	if storageEntry == nil {
-		// If the bucket entry does not exist, this will be the only item the
-		// bucket that is going to be persisted.
-		bucket.Items = []*Item{
-			item,
+	if current.GetVersion() != expectedVersion {
+		return &BucketVersionConflictError{
+			Key:      bucket.Key,
+			Expected: expectedVersion,
+			Actual:   current.GetVersion(),
 		}
-	} else {
-		uncompressedData, notCompressed, err := compressutil.Decompress(storageEntry.Value)
+	}
+
+	return s.putBucket(context.Background(), bucket, current.GetVersion())
+}
+
+// bucketPartKey returns the storage key holding the given part of a bucket
+// whose value was split across multiple storage entries
+func bucketPartKey(key string, part int) string {
+	return fmt.Sprintf("%s.part%d", key, part)
+}
+
+// parsePartsHeader returns the number of parts a bucket storage entry value
+// is split into, along with the data of the first part
+func parsePartsHeader(key string, value []byte) (int, []byte, error) {
+	if len(value) == 0 || value[0] != bucketPartsCanary {
+		return 1, value, nil
+	}
+
+	numParts, n := binary.Uvarint(value[1:])
+	if n <= 0 || numParts < 2 {
+		return 0, nil, fmt.Errorf("invalid multi-part header in %q", key)
+	}
+
+	return int(numParts), value[1+n:], nil
+}
+
+// readBucketEntry returns the raw value of the bucket stored under the given
+// key, reassembling it if it was split across multiple storage entries. A nil
+// value is returned if the bucket doesn't exist.
+func (s *StoragePacker) readBucketEntry(ctx context.Context, key string) ([]byte, error) {
+	storageEntry, err := s.view.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if storageEntry == nil {
+		return nil, nil
+	}
+
+	numParts, value, err := parsePartsHeader(key, storageEntry.Value)
+	if err != nil {
+		return nil, err
+	}
+	if numParts == 1 {
+		return value, nil
+	}
+
+	value = append([]byte(nil), value...)
+	for i := 1; i < numParts; i++ {
+		partEntry, err := s.view.Get(ctx, bucketPartKey(key, i))
 		if err != nil {
-			return errwrap.Wrapf("failed to decompress packed storage entry: {{err}}", err)
+			return nil, err
 		}
-		if notCompressed {
-			uncompressedData = storageEntry.Value
+		if partEntry == nil {
+			return nil, fmt.Errorf("missing part %d of %d of %q", i, numParts, key)
 		}
+		value = append(value, partEntry.Value...)
+	}
 
-		err = proto.Unmarshal(uncompressedData, bucket)
-		if err != nil {
-			return errwrap.Wrapf("failed to decode packed storage entry: {{err}}", err)
-		}
+	return value, nil
+}
 
-		err = bucket.upsert(item)
+// writeBucketEntry stores the raw value of a bucket under the given key. If
+// MaxStorageValueSize is configured and the value exceeds it, the value is
+// split across multiple storage entries. The additional parts are written
+// before the entry under the key itself, so that the header of the latter
+// never refers to parts which are not stored yet. Parts left over from a
+// previous, larger, value are removed afterwards.
+func (s *StoragePacker) writeBucketEntry(ctx context.Context, key string, value []byte) error {
+	return s.writeBucketEntryTo(ctx, s.view, key, value)
+}
+
+// writeBucketEntryTo is like writeBucketEntry, writing to the given view
+func (s *StoragePacker) writeBucketEntryTo(ctx context.Context, view logical.Storage, key string, value []byte) error {
+	maxSize := s.config.MaxStorageValueSize
+	if maxSize <= 0 {
+		return s.putEntry(ctx, view, &logical.StorageEntry{
+			Key:   key,
+			Value: value,
+		})
+	}
+
+	oldNumParts := 1
+	storageEntry, err := view.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if storageEntry != nil {
+		oldNumParts, _, err = parsePartsHeader(key, storageEntry.Value)
 		if err != nil {
-			return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+			return err
 		}
 	}
 
-	// Persist the result
-	return s.PutBucket(bucket)
-}
+	numParts := 1
+	firstValue := value
+	if len(value) > maxSize {
+		// Leave room for the largest possible header in the first part
+		firstSize := maxSize - 1 - binary.MaxVarintLen64
+		numParts = 1 + (len(value)-firstSize+maxSize-1)/maxSize
 
-// NewStoragePacker creates a new storage packer for a given view
-func NewStoragePacker(view logical.Storage, logger log.Logger, viewPrefix string) (*StoragePacker, error) {
-	if view == nil {
-		return nil, fmt.Errorf("nil view")
-	}
+		rest := value[firstSize:]
+		for i := 1; i < numParts; i++ {
+			partSize := maxSize
+			if partSize > len(rest) {
+				partSize = len(rest)
+			}
+
+			err = s.putEntry(ctx, view, &logical.StorageEntry{
+				Key:   bucketPartKey(key, i),
+				Value: rest[:partSize],
+			})
+			if err != nil {
+				return err
+			}
+			rest = rest[partSize:]
+		}
 
-	if viewPrefix == "" {
-		viewPrefix = StoragePackerBucketsPrefix
+		header := make([]byte, 1+binary.MaxVarintLen64)
+		header[0] = bucketPartsCanary
+		n := binary.PutUvarint(header[1:], uint64(numParts))
+		firstValue = append(header[:1+n], value[:firstSize]...)
 	}
 
-	if !strings.HasSuffix(viewPrefix, "/") {
-		viewPrefix = viewPrefix + "/"
+	err = s.putEntry(ctx, view, &logical.StorageEntry{
+		Key:   key,
+		Value: firstValue,
+	})
+	if err != nil {
+		return err
 	}
 
-	// Create a new packer object for the given view
-	packer := &StoragePacker{
-		view:         view,
-		viewPrefix:   viewPrefix,
-		logger:       logger,
-		storageLocks: locksutil.CreateLocks(),
+	for i := numParts; i < oldNumParts; i++ {
+		err = view.Delete(ctx, bucketPartKey(key, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mirrorBucketEntry queues the write of the given bucket or payload value to
+// the secondary view, if any. It never blocks: if the queue is full, or the
+// packer has been closed meanwhile, the write is dropped.
+func (s *StoragePacker) mirrorBucketEntry(key string, value []byte) {
+	if s.mirrorCh == nil {
+		return
+	}
+
+	// The close lock is held so that no write is queued once runMirror has
+	// drained the queue
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		s.logger.Warn("storagepacker: packer is closed, dropping bucket write", "key", key)
+		metrics.IncrCounterWithLabels([]string{"storagepacker", "mirror_failure"}, 1, s.metricsLabels())
+		return
+	}
+
+	select {
+	case s.mirrorCh <- &logical.StorageEntry{Key: key, Value: value}:
+	default:
+		s.logger.Warn("storagepacker: mirror queue is full, dropping bucket write", "key", key)
+		metrics.IncrCounterWithLabels([]string{"storagepacker", "mirror_failure"}, 1, s.metricsLabels())
+	}
+}
+
+// runMirror writes the queued bucket values to the secondary view, in order,
+// until the packer is closed. The writes still queued at that point are
+// written before it returns.
+func (s *StoragePacker) runMirror() {
+	defer s.bgWG.Done()
+
+	for {
+		select {
+		case <-s.closeCh:
+			for {
+				select {
+				case entry := <-s.mirrorCh:
+					s.mirrorEntry(entry)
+				default:
+					return
+				}
+			}
+		case entry := <-s.mirrorCh:
+			s.mirrorEntry(entry)
+		}
+	}
+}
+
+// mirrorEntry writes the given bucket value to the secondary view
+func (s *StoragePacker) mirrorEntry(entry *logical.StorageEntry) {
+	err := s.writeBucketEntryTo(context.Background(), s.config.SecondaryView, entry.Key, entry.Value)
+	if err != nil {
+		s.logger.Warn("storagepacker: failed to mirror bucket", "key", entry.Key, "error", err)
+		metrics.IncrCounterWithLabels([]string{"storagepacker", "mirror_failure"}, 1, s.metricsLabels())
+	}
+}
+
+// GetItem fetches the storage entry for a given key from its corresponding
+// bucket. The payload of a split item is read along with it.
+func (s *StoragePacker) GetItem(itemID string) (*Item, error) {
+	return s.getItem(itemID, true)
+}
+
+// getItem returns the item with the given ID, reading its payload if it is
+// split and withPayload is set
+func (s *StoragePacker) getItem(itemID string, withPayload bool) (*Item, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if itemID == "" {
+		return nil, fmt.Errorf("empty item ID")
+	}
+
+	if err := s.checkItemIDLength(itemID); err != nil {
+		return nil, err
+	}
+
+	bucketPath := s.BucketPath(s.BucketKey(itemID))
+
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	// Fetch the bucket entry
+	bucket, err := s.decodeBucket(context.Background(), bucketPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read packed storage item: {{err}}", err)
+	}
+
+	// Look for a matching storage entry in the bucket items
+	item := bucket.findItem(itemID)
+	if item == nil || !withPayload {
+		return item, nil
+	}
+
+	return s.loadPayload(context.Background(), item)
+}
+
+// PutItem stores a storage entry in its corresponding bucket. If
+// Config.TrackTimestamps is set, the stored copy of the item is stamped with
+// its last update time.
+func (s *StoragePacker) PutItem(item *Item) error {
+	return s.putItem(context.Background(), item, false)
+}
+
+// putItem is PutItem using the given context for storage operations,
+// splitting the item if split is set
+func (s *StoragePacker) putItem(ctx context.Context, item *Item, split bool) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	if item == nil {
+		return fmt.Errorf("nil item")
+	}
+
+	if item.ID == "" {
+		return fmt.Errorf("missing ID in item")
+	}
+
+	if err := s.checkItemIDLength(item.ID); err != nil {
+		return err
+	}
+
+	if err := s.validateItem(item); err != nil {
+		return err
+	}
+
+	var payload *any.Any
+	var err error
+	if split {
+		item, payload, err = splitItem(item)
+	} else {
+		item, payload, err = wholeItem(item)
+	}
+	if err != nil {
+		return err
+	}
+
+	bucketKey := s.BucketKey(item.ID)
+	bucketPath := s.BucketPath(bucketKey)
+
+	// In this case, we persist the storage entry regardless of the read
+	// value below is nil or not. Hence, directly acquire write lock
+	// even to read the entry.
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Check if there is an existing bucket for a given key
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return err
+	}
+	payloadKeys := bucket.payloadKeys()
+
+	if bucket == nil {
+		// If the bucket entry does not exist, this will be the only item the
+		// bucket that is going to be persisted.
+		item, err = s.stampItem(nil, item)
+		if err != nil {
+			return err
+		}
+
+		bucket = &Bucket{
+			Key: bucketPath,
+			Items: []*Item{
+				item,
+			},
+		}
+	} else {
+		existing := bucket.findItem(item.ID)
+		if err := s.checkBucketCapacity(bucket, existing); err != nil {
+			return err
+		}
+		item, err = s.stampItem(existing, item)
+		if err != nil {
+			return err
+		}
+		s.checkItemGrowth(existing, item)
+
+		err = bucket.upsert(item)
+		if err != nil {
+			return errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+		}
+	}
+
+	// The payload of a split item is stored before the bucket refers to it
+	if payload != nil {
+		if err := s.putPayload(ctx, item.PayloadKey, payload); err != nil {
+			return err
+		}
+	}
+
+	// Persist the result
+	if err := s.putBucket(ctx, bucket, bucket.Version); err != nil {
+		if payload != nil {
+			s.deletePayload(ctx, item.PayloadKey)
+		}
+		return err
+	}
+
+	s.releasePayloads(ctx, bucket, payloadKeys)
+
+	return nil
+}
+
+// CompareAndSwapItem loads the item with the given ID and passes it, or nil
+// if it doesn't exist, to predicate. If the predicate returns true, the item
+// it returns replaces the current one; a nil item deletes it. The bucket lock
+// is held throughout, so the swap is atomic with regard to the other
+// operations of the packer. It returns whether a swap happened, which is not
+// the case when deleting an item which doesn't exist.
+func (s *StoragePacker) CompareAndSwapItem(ctx context.Context, itemID string, predicate func(*Item) (bool, *Item)) (bool, error) {
+	if err := s.checkClosed(); err != nil {
+		return false, err
+	}
+
+	if itemID == "" {
+		return false, fmt.Errorf("empty item ID")
+	}
+
+	if err := s.checkItemIDLength(itemID); err != nil {
+		return false, err
+	}
+
+	if predicate == nil {
+		return false, fmt.Errorf("nil predicate")
+	}
+
+	bucketPath := s.BucketPath(s.BucketKey(itemID))
+
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return false, err
+	}
+	if bucket == nil {
+		bucket = &Bucket{
+			Key: bucketPath,
+		}
+	}
+
+	payloadKeys := bucket.payloadKeys()
+
+	existing, err := s.loadPayload(ctx, bucket.findItem(itemID))
+	if err != nil {
+		return false, err
+	}
+
+	swap, item := predicate(existing)
+	if !swap {
+		return false, nil
+	}
+
+	var removedIDs []string
+	switch {
+	case item == nil:
+		if !bucket.remove(itemID) {
+			// Nothing to delete, so nothing is swapped
+			return false, nil
+		}
+		removedIDs = append(removedIDs, itemID)
+
+	case item.ID != itemID:
+		return false, fmt.Errorf("swapped item ID %q doesn't match %q", item.ID, itemID)
+
+	default:
+		if err := s.validateItem(item); err != nil {
+			return false, err
+		}
+		item, _, err = wholeItem(item)
+		if err != nil {
+			return false, err
+		}
+		if err := s.checkBucketCapacity(bucket, existing); err != nil {
+			return false, err
+		}
+		item, err = s.stampItem(existing, item)
+		if err != nil {
+			return false, err
+		}
+		s.checkItemGrowth(existing, item)
+
+		err = bucket.upsert(item)
+		if err != nil {
+			return false, errwrap.Wrapf("failed to update entry in packed storage entry: {{err}}", err)
+		}
+	}
+
+	if err := s.putBucketRemovingItems(ctx, bucket, bucket.Version, removedIDs); err != nil {
+		return false, err
+	}
+
+	s.releasePayloads(ctx, bucket, payloadKeys)
+
+	return true, nil
+}
+
+// metricsLabels returns the labels added to the metrics emitted by the
+// packer, which distinguish packers sharing a metrics sink
+func (s *StoragePacker) metricsLabels() []metrics.Label {
+	return []metrics.Label{{Name: "prefix", Value: s.viewPrefix}}
+}
+
+// stampItem returns the item to store in place of existing, which is nil if
+// the item is new. If timestamps are tracked, this is a copy of the item
+// carrying its timestamps, keeping the creation time of the existing item;
+// otherwise it is the item itself.
+func (s *StoragePacker) stampItem(existing, item *Item) (*Item, error) {
+	if !s.config.TrackTimestamps {
+		return item, nil
+	}
+
+	now, err := ptypes.TimestampProto(s.now())
+	if err != nil {
+		return nil, errwrap.Wrapf("invalid current time: {{err}}", err)
+	}
+
+	stamped := *item
+	stamped.LastUpdateTime = now
+	stamped.CreationTime = now
+	if existing != nil && existing.CreationTime != nil {
+		stamped.CreationTime = existing.CreationTime
+	}
+
+	return &stamped, nil
+}
+
+// validateItem runs the configured item validator, if any, on item
+func (s *StoragePacker) validateItem(item *Item) error {
+	if s.config.ItemValidator == nil {
+		return nil
+	}
+	return s.config.ItemValidator(item)
+}
+
+// checkItemIDLength returns ErrItemIDTooLong if itemID is longer than the
+// configured maximum
+func (s *StoragePacker) checkItemIDLength(itemID string) error {
+	if s.config.MaxItemIDLength > 0 && len(itemID) > s.config.MaxItemIDLength {
+		return ErrItemIDTooLong
+	}
+	return nil
+}
+
+// checkBucketCapacity returns ErrPrimaryBucketFull if a new item can't be
+// added to bucket. existing is the current version of the item being
+// written, which is nil if the item is new.
+func (s *StoragePacker) checkBucketCapacity(bucket *Bucket, existing *Item) error {
+	if s.config.MaxItemsPerPrimary == 0 || existing != nil {
+		return nil
+	}
+
+	if len(bucket.Items) >= s.config.MaxItemsPerPrimary {
+		return ErrPrimaryBucketFull
+	}
+
+	return nil
+}
+
+// now returns the current time according to the configured clock
+func (s *StoragePacker) now() time.Time {
+	return s.config.Clock()
+}
+
+// checkItemGrowth reports the item if it grew by more than the configured
+// threshold compared to existing, its current version, which is nil if the
+// item is new
+func (s *StoragePacker) checkItemGrowth(existing, item *Item) {
+	if s.config.ItemGrowthThreshold <= 0 || existing == nil {
+		return
+	}
+
+	oldSize, newSize := proto.Size(existing), proto.Size(item)
+	if newSize-oldSize > s.config.ItemGrowthThreshold {
+		s.logger.Warn("storagepacker: item grew beyond threshold in a single update", "item_id", item.ID, "old_size", oldSize, "new_size", newSize, "threshold", s.config.ItemGrowthThreshold)
+		metrics.IncrCounterWithLabels([]string{"storagepacker", "item_growth"}, 1, s.metricsLabels())
+	}
+}
+
+// PurgeAll deletes all the buckets managed by the packer, along with the
+// payloads of split items and the bucket index. To avoid flooding the
+// underlying storage with deletes, at most batchSize buckets are deleted at
+// any time. The context is checked between batches, so a long purge can be
+// aborted; in that case the context's error is returned and the remaining
+// buckets are left untouched. Tombstones are kept on purpose: they record the
+// deletions of items for auditing, and purging the items doesn't make that
+// record irrelevant.
+func (s *StoragePacker) PurgeAll(ctx context.Context, batchSize int) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	if batchSize <= 0 {
+		return fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	keys, err := s.listBucketKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(keys); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var wg sync.WaitGroup
+		var errLock sync.Mutex
+		var retErr *multierror.Error
+		for _, key := range keys[start:end] {
+			wg.Add(1)
+			go func(bucketPath string) {
+				defer wg.Done()
+
+				lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+				lock.Lock()
+				defer lock.Unlock()
+
+				if err := s.deleteBucketEntry(ctx, bucketPath); err != nil {
+					errLock.Lock()
+					retErr = multierror.Append(retErr, errwrap.Wrapf(fmt.Sprintf("failed to delete packed storage bucket %q: {{err}}", bucketPath), err))
+					errLock.Unlock()
+				}
+			}(s.BucketPath(key))
+		}
+		wg.Wait()
+
+		if err := retErr.ErrorOrNil(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.purgePayloads(ctx); err != nil {
+		return err
+	}
+
+	return s.clearBucketIndex(ctx)
+}
+
+// deleteBucketEntry deletes the bucket stored under the given key, including
+// the additional parts of a bucket split across multiple storage entries.
+// The parts are deleted first, so that an interrupted deletion leaves the
+// entry under the key behind to be deleted again.
+func (s *StoragePacker) deleteBucketEntry(ctx context.Context, key string) error {
+	storageEntry, err := s.view.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if storageEntry == nil {
+		return nil
+	}
+
+	numParts, _, err := parsePartsHeader(key, storageEntry.Value)
+	if err != nil {
+		return err
+	}
+	for i := 1; i < numParts; i++ {
+		err = s.view.Delete(ctx, bucketPartKey(key, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.view.Delete(ctx, key)
+}
+
+// listBucketKeys returns the keys, relative to the view prefix, of all the
+// buckets stored by the packer, by listing the underlying storage. Additional
+// parts of buckets which are split across multiple storage entries, and the
+// keys reserved by the packer, are not included.
+func (s *StoragePacker) listBucketKeys(ctx context.Context) ([]string, error) {
+	keys, err := s.view.List(ctx, s.viewPrefix)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to list packed storage buckets: {{err}}", err)
+	}
+
+	bucketKeys := keys[:0]
+	for _, key := range keys {
+		if strings.HasPrefix(key, "_") || strings.Contains(key, ".part") {
+			continue
+		}
+		bucketKeys = append(bucketKeys, key)
+	}
+
+	return bucketKeys, nil
+}
+
+// bucketKeys returns the keys, relative to the view prefix, of the buckets
+// which may hold items. These are taken from the bucket index if enabled.
+func (s *StoragePacker) bucketKeys(ctx context.Context) ([]string, error) {
+	if s.config.IndexBuckets {
+		return s.indexedBucketKeys(ctx)
+	}
+
+	return s.listBucketKeys(ctx)
+}
+
+// walkBuckets calls fn for each bucket stored by the packer. Every bucket is
+// read under its read lock, which is released before fn is invoked.
+func (s *StoragePacker) walkBuckets(ctx context.Context, fn func(*Bucket) error) error {
+	return s.walkBucketsSkipping(ctx, nil, fn)
+}
+
+// walkBucketsSkipping is like walkBuckets, but if onCorrupt is set, buckets
+// which can't be decoded are passed to it and skipped rather than aborting
+// the walk. Errors reading the storage still abort the walk.
+func (s *StoragePacker) walkBucketsSkipping(ctx context.Context, onCorrupt func(key string, err error), fn func(*Bucket) error) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	keys, err := s.bucketKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bucketPath := s.BucketPath(key)
+
+		lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+		lock.RLock()
+		bucket, err := s.decodeBucket(ctx, bucketPath)
+		lock.RUnlock()
+		if _, ok := err.(*corruptBucketError); ok && onCorrupt != nil {
+			onCorrupt(bucketPath, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// The bucket may have been removed since it was listed
+		if bucket == nil {
+			continue
+		}
+
+		err = fn(bucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListItemIDsWithPrefix returns the IDs of all the items whose ID starts with
+// the given prefix. Items are placed in buckets by the hash of their ID, which
+// destroys any locality of their prefixes, so this reads every bucket stored
+// by the packer.
+func (s *StoragePacker) ListItemIDsWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var itemIDs []string
+	err := s.walkBuckets(ctx, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			if strings.HasPrefix(item.ID, prefix) {
+				itemIDs = append(itemIDs, item.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return itemIDs, nil
+}
+
+// WalkItemsSorted calls fn for each item stored by the packer, in the order
+// of their IDs. All the item IDs are first collected and sorted, so memory
+// usage grows with the number of items; the items themselves are then read
+// one at a time through GetItem. Items deleted during the walk are skipped.
+func (s *StoragePacker) WalkItemsSorted(ctx context.Context, fn func(*Item) error) error {
+	itemIDs, err := s.ListItemIDsWithPrefix(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(itemIDs)
+
+	for _, itemID := range itemIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		item, err := s.GetItem(itemID)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			continue
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListItemsModifiedSince returns the IDs of all the items which were last
+// written after the given time. Items which don't carry a last update time,
+// because they were written without Config.TrackTimestamps set, are not
+// returned. This reads every bucket stored by the packer.
+func (s *StoragePacker) ListItemsModifiedSince(ctx context.Context, since time.Time) ([]string, error) {
+	var itemIDs []string
+	err := s.walkBuckets(ctx, func(bucket *Bucket) error {
+		for _, item := range bucket.Items {
+			if item.LastUpdateTime == nil {
+				continue
+			}
+
+			lastUpdateTime, err := ptypes.Timestamp(item.LastUpdateTime)
+			if err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("invalid last update time of item %q: {{err}}", item.ID), err)
+			}
+
+			if lastUpdateTime.After(since) {
+				itemIDs = append(itemIDs, item.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return itemIDs, nil
+}
+
+// Compact removes the storage entries of buckets which no longer hold any
+// items. Deleting the last item of a bucket leaves an empty bucket behind;
+// this reclaims those entries. Each bucket is re-read and deleted under its
+// write lock so that compaction never races with foreground operations. The
+// version of a removed bucket is kept apart, so that versions keep
+// increasing if the bucket is written again. It returns the number of
+// buckets removed.
+func (s *StoragePacker) Compact(ctx context.Context) (int, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	keys, err := s.listBucketKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		deleted, err := s.removeBucketIfEmpty(ctx, s.BucketPath(key))
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func (s *StoragePacker) removeBucketIfEmpty(ctx context.Context, bucketPath string) (bool, error) {
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return false, err
+	}
+	if bucket == nil || len(bucket.Items) != 0 {
+		return false, nil
+	}
+
+	// The version is recorded before the bucket goes away, so that a failed
+	// delete only leaves an extra entry behind
+	if bucket.Version != 0 {
+		value, err := jsonutil.EncodeJSON(&removedBucketEntry{
+			Version: bucket.Version,
+		})
+		if err != nil {
+			return false, errwrap.Wrapf("failed to encode removed bucket version: {{err}}", err)
+		}
+
+		err = s.view.Put(ctx, &logical.StorageEntry{
+			Key:   s.removedBucketKey(bucketPath),
+			Value: value,
+		})
+		if err != nil {
+			return false, errwrap.Wrapf("failed to persist removed bucket version: {{err}}", err)
+		}
+	}
+
+	err = s.view.Delete(ctx, bucketPath)
+	if err != nil {
+		return false, errwrap.Wrapf("failed to delete packed storage entry: {{err}}", err)
+	}
+
+	return true, nil
+}
+
+// removedBucketEntry is the persisted form of the version of a bucket removed
+// by Compact
+type removedBucketEntry struct {
+	Version uint64 `json:"version"`
+}
+
+// removedBucketKey returns the storage key holding the version the bucket
+// stored under the given key had when Compact removed it
+func (s *StoragePacker) removedBucketKey(bucketPath string) string {
+	return s.viewPrefix + removedBucketsPrefix + strings.TrimPrefix(bucketPath, s.viewPrefix)
+}
+
+// removedBucketVersion returns the version the bucket stored under the given
+// key had when Compact removed it, or 0 if it was never removed. Callers are
+// expected to hold the lock for the key.
+func (s *StoragePacker) removedBucketVersion(ctx context.Context, bucketPath string) (uint64, error) {
+	entry, err := s.view.Get(ctx, s.removedBucketKey(bucketPath))
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to read removed bucket version: {{err}}", err)
+	}
+	if entry == nil {
+		return 0, nil
+	}
+
+	var removed removedBucketEntry
+	if err := jsonutil.DecodeJSON(entry.Value, &removed); err != nil {
+		return 0, errwrap.Wrapf("failed to decode removed bucket version: {{err}}", err)
+	}
+
+	return removed.Version, nil
+}
+
+// StartCompactor starts a background goroutine which runs Compact every
+// interval, until the given context is cancelled or the packer is closed.
+func (s *StoragePacker) StartCompactor(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid compaction interval %v", interval)
+	}
+
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	s.bgWG.Add(1)
+	go func() {
+		defer s.bgWG.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.closeCh:
+				return
+			case <-ticker.C:
+				removed, err := s.Compact(ctx)
+				switch {
+				case err == ErrClosed:
+					return
+				case err != nil && ctx.Err() == nil:
+					s.logger.Error("storagepacker: failed to compact buckets", "error", err)
+				case removed > 0:
+					s.logger.Debug("storagepacker: compacted buckets", "removed", removed)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops the background goroutines started by the packer, waiting for
+// them to exit, and drops its in-memory state. Any operation on the packer
+// after it is closed returns ErrClosed. It is safe to call Close multiple
+// times.
+func (s *StoragePacker) Close() error {
+	s.closeLock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.closeCh)
+	}
+	s.closeLock.Unlock()
+
+	s.bgWG.Wait()
+	s.resetBucketIndex()
+
+	return nil
+}
+
+func (s *StoragePacker) checkClosed() error {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// NewStoragePacker creates a new storage packer for a given view
+func NewStoragePacker(view logical.Storage, logger log.Logger, viewPrefix string) (*StoragePacker, error) {
+	return NewStoragePackerWithConfig(&Config{
+		View:       view,
+		Logger:     logger,
+		ViewPrefix: viewPrefix,
+	})
+}
+
+// NewStoragePackerWithConfig creates a new storage packer using the given
+// configuration
+func NewStoragePackerWithConfig(config *Config) (*StoragePacker, error) {
+	if config == nil {
+		return nil, fmt.Errorf("nil config")
+	}
+
+	if config.View == nil {
+		return nil, fmt.Errorf("nil view")
+	}
+
+	if config.MaxStorageValueSize < 0 {
+		return nil, fmt.Errorf("invalid max storage value size %d", config.MaxStorageValueSize)
+	}
+
+	if config.MaxStorageValueSize > 0 && config.MaxStorageValueSize < minStorageValueSize {
+		return nil, fmt.Errorf("max storage value size should be at least %d bytes", minStorageValueSize)
+	}
+
+	if config.CompressionMinSize < 0 {
+		return nil, fmt.Errorf("invalid compression min size %d", config.CompressionMinSize)
+	}
+
+	if config.MaxItemsPerPrimary < 0 {
+		return nil, fmt.Errorf("invalid max items per primary %d", config.MaxItemsPerPrimary)
+	}
+
+	if config.MaxItemIDLength < 0 {
+		return nil, fmt.Errorf("invalid max item ID length %d", config.MaxItemIDLength)
+	}
+
+	config = config.withDefaults()
+
+	// Create a new packer object for the given view
+	packer := &StoragePacker{
+		view:         config.View,
+		viewPrefix:   config.ViewPrefix,
+		logger:       config.Logger,
+		storageLocks: locksutil.CreateLocks(),
+		config:       config,
+		closeCh:      make(chan struct{}),
+	}
+
+	if config.SecondaryView != nil {
+		packer.mirrorCh = make(chan *logical.StorageEntry, mirrorQueueSize)
+		packer.bgWG.Add(1)
+		go packer.runMirror()
 	}
 
 	return packer, nil
 }
+
+// DefaultConfig returns the configuration of a storage packer using the given
+// view and prefix, with all the defaults resolved. It can be inspected or
+// modified before being passed to NewStoragePackerWithConfig.
+func DefaultConfig(view logical.Storage, viewPrefix string) *Config {
+	return (&Config{
+		View:       view,
+		ViewPrefix: viewPrefix,
+	}).withDefaults()
+}
+
+// withDefaults returns a copy of the configuration with the defaults applied
+// to the unset fields
+func (c *Config) withDefaults() *Config {
+	config := *c
+
+	if config.Logger == nil {
+		config.Logger = log.NullLog
+	}
+
+	if config.ViewPrefix == "" {
+		config.ViewPrefix = StoragePackerBucketsPrefix
+	}
+
+	if !strings.HasSuffix(config.ViewPrefix, "/") {
+		config.ViewPrefix = config.ViewPrefix + "/"
+	}
+
+	if config.ItemCodec == nil {
+		config.ItemCodec = ProtoItemCodec{}
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	return &config
+}
@@ -1,12 +1,30 @@
 package storagepacker
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/compressutil"
 	"github.com/hashicorp/vault/helper/identity"
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/helper/logformat"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	log "github.com/mgutz/logxi/v1"
 )
@@ -60,6 +78,98 @@ func BenchmarkStoragePacker(b *testing.B) {
 	}
 }
 
+// benchmarkItemCount is the number of items stored by the benchmarks
+// before measuring, so that buckets hold a realistic number of items
+const benchmarkItemCount = 4096
+
+// benchmarkItemID returns a deterministic item ID, keeping the layout of the
+// buckets, and hence the results, stable across runs
+func benchmarkItemID(i int) string {
+	return fmt.Sprintf("benchmark-item-%d", i)
+}
+
+// newBenchmarkPacker returns a packer on an in-memory view holding
+// benchmarkItemCount items. config may be nil; its View is replaced.
+func newBenchmarkPacker(b *testing.B, config *Config) *StoragePacker {
+	if config == nil {
+		config = &Config{}
+	}
+	config.View = &logical.InmemStorage{}
+
+	storagePacker, err := NewStoragePackerWithConfig(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < benchmarkItemCount; i++ {
+		if err := storagePacker.PutItem(&Item{ID: benchmarkItemID(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return storagePacker
+}
+
+func BenchmarkPutItem(b *testing.B) {
+	storagePacker := newBenchmarkPacker(b, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storagePacker.PutItem(&Item{ID: benchmarkItemID(i % benchmarkItemCount)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetItem(b *testing.B) {
+	storagePacker := newBenchmarkPacker(b, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		item, err := storagePacker.GetItem(benchmarkItemID(i % benchmarkItemCount))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if item == nil {
+			b.Fatal("item not found")
+		}
+	}
+}
+
+func BenchmarkDeleteItem(b *testing.B) {
+	storagePacker := newBenchmarkPacker(b, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Deleting an item which was already deleted costs as much as
+		// deleting an existing one, as the bucket is read in both cases
+		if err := storagePacker.DeleteItem(benchmarkItemID(i % benchmarkItemCount)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPutItemSingleBucket measures writes when all the items collide in
+// the same bucket, the worst case of a skewed ID distribution
+func BenchmarkPutItemSingleBucket(b *testing.B) {
+	storagePacker := newBenchmarkPacker(b, &Config{
+		PrimaryIndexFunc: func(string) uint8 {
+			return 0
+		},
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storagePacker.PutItem(&Item{ID: benchmarkItemID(i % benchmarkItemCount)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestStoragePacker(t *testing.T) {
 	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
 	if err != nil {
@@ -170,3 +280,3186 @@ func TestStoragePacker_SerializeDeserializeComplexItem(t *testing.T) {
 		t.Fatalf("bad: expected: %#v\nactual: %#v\n", entity, itemDecoded)
 	}
 }
+
+// cancelingStorage cancels the given context once it has served the first
+// Delete call and counts all the Delete calls it receives.
+type cancelingStorage struct {
+	logical.Storage
+
+	l       sync.Mutex
+	deletes int
+	cancel  context.CancelFunc
+}
+
+func (c *cancelingStorage) Delete(ctx context.Context, key string) error {
+	c.l.Lock()
+	c.deletes++
+	c.l.Unlock()
+
+	c.cancel()
+	return c.Storage.Delete(ctx, key)
+}
+
+// countingStorage counts the Put calls it receives
+type countingStorage struct {
+	logical.Storage
+
+	l     sync.Mutex
+	nPuts int
+}
+
+func (c *countingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	c.l.Lock()
+	c.nPuts++
+	c.l.Unlock()
+
+	return c.Storage.Put(ctx, entry)
+}
+
+func (c *countingStorage) puts() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.nPuts
+}
+
+func (c *countingStorage) reset() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	c.nPuts = 0
+}
+
+func TestStoragePacker_PurgeAll(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = storagePacker.PutItem(&Item{
+			ID: fmt.Sprintf("item%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storagePacker.PurgeAll(context.Background(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := storagePacker.View().List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected all buckets to be purged, %d left", len(keys))
+	}
+}
+
+func TestStoragePacker_PurgeAll_Reserved(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:                view,
+		Logger:              log.New("storagepackertest"),
+		MaxStorageValueSize: 128,
+		IndexBuckets:        true,
+		RecordTombstones:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Large items are split across multiple storage entries
+	for i := 0; i < 20; i++ {
+		value, err := uuid.GenerateRandomBytes(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storagePacker.PutItem(&Item{
+			ID:      fmt.Sprintf("item%d", i),
+			Message: &any.Any{Value: value},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storagePacker.DeleteItem("item0"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.StrListContains(keys, bucketIndexKey) || !strings.Contains(strings.Join(keys, ","), ".part") {
+		t.Fatalf("expected bucket parts and a bucket index, got %v", keys)
+	}
+
+	err = storagePacker.PurgeAll(context.Background(), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parts and the bucket index are purged, the tombstones are kept
+	keys, err = view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{tombstonesPrefix}) {
+		t.Fatalf("expected only the tombstones to be left, got %v", keys)
+	}
+	if _, ok, err := storagePacker.GetDeletionTime(context.Background(), "item0"); err != nil || !ok {
+		t.Fatalf("expected the tombstone of item0 to be kept: %v", err)
+	}
+
+	// The index is rebuilt from the storage once items are put again
+	err = storagePacker.PutItem(&Item{
+		ID: "item1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	itemIDs, err := storagePacker.ListItemIDsWithPrefix(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(itemIDs, []string{"item1"}) {
+		t.Fatalf("bad: item IDs: %v", itemIDs)
+	}
+}
+
+func TestStoragePacker_PurgeAll_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	view := &cancelingStorage{
+		Storage: &logical.InmemStorage{},
+		cancel:  cancel,
+	}
+
+	storagePacker, err := NewStoragePacker(view, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = storagePacker.PutItem(&Item{
+			ID: fmt.Sprintf("item%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := view.List(ctx, StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PurgeAll(ctx, 4)
+	if err != context.Canceled {
+		t.Fatalf("expected context cancellation error, got %v", err)
+	}
+
+	// Only the first batch must have been issued
+	if view.deletes != 4 {
+		t.Fatalf("expected 4 deletes, got %d", view.deletes)
+	}
+
+	remaining, err := view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != len(keys)-4 {
+		t.Fatalf("expected %d buckets to remain, got %d", len(keys)-4, len(remaining))
+	}
+}
+
+func TestStoragePacker_NewItem(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &identity.Entity{
+		ID:       "entity_id",
+		Name:     "entity_name",
+		Policies: []string{"policy1"},
+	}
+
+	item, err := NewItem(entity.ID, entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedItem, err := storagePacker.GetItem(entity.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded identity.Entity
+	err = fetchedItem.Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, entity) {
+		t.Fatalf("bad: expected: %#v\nactual: %#v\n", entity, decoded)
+	}
+
+	_, err = NewItem("", entity)
+	if err == nil {
+		t.Fatal("expected an error for an empty item ID")
+	}
+}
+
+func TestStoragePacker_MaxStorageValueSize(t *testing.T) {
+	maxSize := 128
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:                view,
+		Logger:              log.New("storagepackertest"),
+		MaxStorageValueSize: maxSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Place several items with random IDs in the same bucket so that the
+	// bucket can't fit in a single storage entry
+	var bucketKey string
+	var itemIDs []string
+	for len(itemIDs) < 20 {
+		itemID, err := uuid.GenerateUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucketKey == "" {
+			bucketKey = storagePacker.BucketKey(itemID)
+		}
+		if storagePacker.BucketKey(itemID) != bucketKey {
+			continue
+		}
+		itemIDs = append(itemIDs, itemID)
+
+		err = storagePacker.PutItem(&Item{
+			ID: itemID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucketPath := storagePacker.BucketPath(bucketKey)
+	entry, err := view.Get(context.Background(), bucketPartKey(bucketPath, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Fatal("expected the bucket to be split across multiple storage entries")
+	}
+
+	keys, err := view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		entry, err := view.Get(context.Background(), StoragePackerBucketsPrefix+key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entry.Value) > maxSize {
+			t.Fatalf("storage entry %q exceeds the max size: %d", key, len(entry.Value))
+		}
+	}
+
+	for _, itemID := range itemIDs {
+		item, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil || item.ID != itemID {
+			t.Fatalf("failed to read back item %q", itemID)
+		}
+	}
+
+	// Shrinking the bucket should clean up the parts which are not needed
+	// anymore
+	for _, itemID := range itemIDs[1:] {
+		err = storagePacker.DeleteItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err = view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != bucketKey {
+		t.Fatalf("expected a single storage entry, got %v", keys)
+	}
+
+	item, err := storagePacker.GetItem(itemIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.ID != itemIDs[0] {
+		t.Fatalf("failed to read back item %q", itemIDs[0])
+	}
+}
+
+func TestStoragePacker_StartCompactor(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		err = storagePacker.PutItem(&Item{
+			ID: fmt.Sprintf("item%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Delete all but one item; this leaves empty buckets behind
+	for i := 1; i < 50; i++ {
+		err = storagePacker.DeleteItem(fmt.Sprintf("item%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = storagePacker.StartCompactor(ctx, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := storagePacker.View().List(context.Background(), StoragePackerBucketsPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The bucket of item0 is left, along with the versions of the
+		// removed buckets
+		if len(keys) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("empty buckets were not reclaimed; %d keys left", len(keys))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	item, err := storagePacker.GetItem("item0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil {
+		t.Fatal("compaction removed a bucket which was not empty")
+	}
+}
+
+func TestStoragePacker_ListItemIDsWithPrefix(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		entityID := fmt.Sprintf("entity/%d", i)
+		expected = append(expected, entityID)
+		for _, itemID := range []string{entityID, fmt.Sprintf("alias/%d", i)} {
+			err = storagePacker.PutItem(&Item{
+				ID: itemID,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	itemIDs, err := storagePacker.ListItemIDsWithPrefix(context.Background(), "entity/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(expected)
+	sort.Strings(itemIDs)
+	if !reflect.DeepEqual(itemIDs, expected) {
+		t.Fatalf("bad: item IDs; expected: %v\n actual: %v", expected, itemIDs)
+	}
+}
+
+func TestStoragePacker_ListItemsModifiedSince(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:            &logical.InmemStorage{},
+		Logger:          log.New("storagepackertest"),
+		TrackTimestamps: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = storagePacker.PutItem(&Item{
+			ID: fmt.Sprintf("old%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	var expected []string
+	for i := 0; i < 5; i++ {
+		itemID := fmt.Sprintf("new%d", i)
+		expected = append(expected, itemID)
+		err = storagePacker.PutItem(&Item{
+			ID: itemID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rewriting an old item makes it modified after the cutoff
+	err = storagePacker.PutItem(&Item{
+		ID: "old0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "old0")
+
+	itemIDs, err := storagePacker.ListItemsModifiedSince(context.Background(), cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(expected)
+	sort.Strings(itemIDs)
+	if !reflect.DeepEqual(itemIDs, expected) {
+		t.Fatalf("bad: item IDs; expected: %v\n actual: %v", expected, itemIDs)
+	}
+}
+
+func TestStoragePacker_IndexBuckets(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:         view,
+		Logger:       log.New("storagepackertest"),
+		IndexBuckets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Churn through items so that buckets are created and emptied
+	for i := 0; i < 200; i++ {
+		err = storagePacker.PutItem(&Item{
+			ID: fmt.Sprintf("item%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i += 3 {
+		err = storagePacker.DeleteItem(fmt.Sprintf("item%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if i%3 == 0 || i%5 == 0 {
+			continue
+		}
+		err = storagePacker.DeleteItem(fmt.Sprintf("item%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compute the non-empty buckets from the storage itself
+	keys, err := view.List(context.Background(), StoragePackerBucketsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, key := range keys {
+		if key == bucketIndexKey {
+			continue
+		}
+		bucket, err := storagePacker.GetBucket(storagePacker.BucketPath(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bucket.Items) != 0 {
+			expected = append(expected, key)
+		}
+	}
+
+	entry, err := view.Get(context.Background(), StoragePackerBucketsPrefix+bucketIndexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry == nil {
+		t.Fatal("bucket index was not persisted")
+	}
+	var indexEntry bucketIndexEntry
+	err = jsonutil.DecodeJSON(entry.Value, &indexEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(expected)
+	if !reflect.DeepEqual(indexEntry.Buckets, expected) {
+		t.Fatalf("bad: bucket index; expected: %v\n actual: %v", expected, indexEntry.Buckets)
+	}
+
+	// A new packer on the same view lists items through the persisted index
+	storagePacker, err = NewStoragePackerWithConfig(&Config{
+		View:         view,
+		Logger:       log.New("storagepackertest"),
+		IndexBuckets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itemIDs, err := storagePacker.ListItemIDsWithPrefix(context.Background(), "item")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expectedIDs []string
+	for i := 0; i < 200; i++ {
+		if i%3 != 0 && i%5 == 0 {
+			expectedIDs = append(expectedIDs, fmt.Sprintf("item%d", i))
+		}
+	}
+	sort.Strings(expectedIDs)
+	sort.Strings(itemIDs)
+	if !reflect.DeepEqual(itemIDs, expectedIDs) {
+		t.Fatalf("bad: item IDs; expected: %v\n actual: %v", expectedIDs, itemIDs)
+	}
+}
+
+func TestStoragePacker_Close(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItem(&Item{
+		ID: "item1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.StartCompactor(context.Background(), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close waits for the compactor to exit
+	doneCh := make(chan struct{})
+	go func() {
+		storagePacker.Close()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the compactor to stop")
+	}
+
+	// Closing again is a no-op
+	err = storagePacker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storagePacker.GetItem("item1")
+	if err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	err = storagePacker.PutItem(&Item{
+		ID: "item2",
+	})
+	if err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	err = storagePacker.StartCompactor(context.Background(), time.Millisecond)
+	if err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestStoragePacker_JSONItemCodec(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:      &logical.InmemStorage{},
+		Logger:    log.New("storagepackertest"),
+		ItemCodec: JSONItemCodec{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type payload struct {
+		Name     string            `json:"name"`
+		Policies []string          `json:"policies"`
+		Metadata map[string]string `json:"metadata"`
+	}
+
+	expected := &payload{
+		Name:     "name",
+		Policies: []string{"policy1", "policy2"},
+		Metadata: map[string]string{
+			"key": "value",
+		},
+	}
+
+	item, err := storagePacker.EncodeItem("item1", expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Message.TypeUrl != JSONItemTypeURL {
+		t.Fatalf("bad: type URL: %q", item.Message.TypeUrl)
+	}
+
+	err = storagePacker.PutItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedItem, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual payload
+	err = storagePacker.DecodeItem(fetchedItem, &actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&actual, expected) {
+		t.Fatalf("bad: expected: %#v\nactual: %#v\n", expected, actual)
+	}
+}
+
+func TestStoragePacker_PutBucketCAS(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketPath := storagePacker.BucketPath(storagePacker.BucketKey("item1"))
+
+	// A bucket which doesn't exist yet has version 0
+	err = storagePacker.PutBucketCAS(&Bucket{
+		Key:   bucketPath,
+		Items: []*Item{{ID: "item1"}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two writers read the same bucket
+	bucket1, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket2, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket1.Version != 1 || bucket2.Version != 1 {
+		t.Fatalf("bad: versions: %d, %d", bucket1.Version, bucket2.Version)
+	}
+
+	// The first writer wins
+	bucket1.Items = append(bucket1.Items, &Item{ID: "item2"})
+	err = storagePacker.PutBucketCAS(bucket1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket1.Version != 2 {
+		t.Fatalf("bad: version: %d", bucket1.Version)
+	}
+
+	// The second writer gets a conflict
+	bucket2.Items = append(bucket2.Items, &Item{ID: "item3"})
+	err = storagePacker.PutBucketCAS(bucket2, 1)
+	conflictErr, ok := err.(*BucketVersionConflictError)
+	if !ok {
+		t.Fatalf("expected a version conflict error, got %v", err)
+	}
+	if conflictErr.Expected != 1 || conflictErr.Actual != 2 {
+		t.Fatalf("bad: conflict error: %#v", conflictErr)
+	}
+
+	bucket, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bucket.Items) != 2 || bucket.Items[1].ID != "item2" {
+		t.Fatalf("bad: bucket: %#v", bucket)
+	}
+
+	// Item updates bump the version too
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storagePacker.PutBucketCAS(bucket, 2)
+	if _, ok := err.(*BucketVersionConflictError); !ok {
+		t.Fatalf("expected a version conflict error, got %v", err)
+	}
+}
+
+func TestStoragePacker_PutBucketStaleVersion(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketPath := storagePacker.BucketPath(storagePacker.BucketKey("item1"))
+
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Version != 1 || current.Version != 2 {
+		t.Fatalf("bad: versions: %d, %d", stale.Version, current.Version)
+	}
+
+	// A write of a copy read at an older version still bumps the stored
+	// version
+	err = storagePacker.PutBucket(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale.Version != 3 {
+		t.Fatalf("bad: version: %d", stale.Version)
+	}
+
+	// so that a writer holding the bucket read before it gets a conflict
+	current.Items = append(current.Items, &Item{ID: "item2"})
+	err = storagePacker.PutBucketCAS(current, 2)
+	conflictErr, ok := err.(*BucketVersionConflictError)
+	if !ok {
+		t.Fatalf("expected a version conflict error, got %v", err)
+	}
+	if conflictErr.Expected != 2 || conflictErr.Actual != 3 {
+		t.Fatalf("bad: conflict error: %#v", conflictErr)
+	}
+
+	err = storagePacker.PutBucketCAS(current, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != 4 {
+		t.Fatalf("bad: version: %d", current.Version)
+	}
+}
+
+func TestStoragePacker_CompactKeepsVersion(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePacker(view, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketPath := storagePacker.BucketPath(storagePacker.BucketKey("item1"))
+
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.DeleteItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := storagePacker.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("bad: removed: %d", removed)
+	}
+
+	// The storage entry of the bucket is gone
+	entry, err := view.Get(context.Background(), bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatal("expected the bucket to be deleted")
+	}
+
+	// The bucket gets a version above the one it was removed at when it is
+	// created again
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storagePacker.GetBucket(bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Version != 3 {
+		t.Fatalf("bad: version: %d", bucket.Version)
+	}
+
+	// so that a writer holding the bucket read before it gets a conflict
+	stale.Items = append(stale.Items, &Item{ID: "item2"})
+	err = storagePacker.PutBucketCAS(stale, stale.Version)
+	conflictErr, ok := err.(*BucketVersionConflictError)
+	if !ok {
+		t.Fatalf("expected a version conflict error, got %v", err)
+	}
+	if conflictErr.Expected != 1 || conflictErr.Actual != 3 {
+		t.Fatalf("bad: conflict error: %#v", conflictErr)
+	}
+}
+func TestStoragePacker_ExportManifest(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]*ManifestEntry)
+	for i := 0; i < 10; i++ {
+		item, err := NewItem(fmt.Sprintf("item%d", i), &identity.Entity{
+			ID:   fmt.Sprintf("item%d", i),
+			Name: fmt.Sprintf("sensitive-name-%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storagePacker.PutItem(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// PutItem sets the last update time of the item, so the item
+		// matches the stored one
+		expected[item.ID] = &ManifestEntry{
+			ID:        item.ID,
+			BucketKey: storagePacker.BucketKey(item.ID),
+			Size:      proto.Size(item),
+		}
+	}
+
+	var buf bytes.Buffer
+	err = storagePacker.ExportManifest(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(buf.String(), "sensitive-name") {
+		t.Fatalf("manifest contains item payloads: %s", buf.String())
+	}
+
+	actual := make(map[string]*ManifestEntry)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry ManifestEntry
+		err := jsonutil.DecodeJSON(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual[entry.ID] = &entry
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: manifest; expected: %#v\nactual: %#v\n", expected, actual)
+	}
+}
+
+func TestStoragePacker_StrictKeyValidation(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:                &logical.InmemStorage{},
+		StrictKeyValidation: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items still go through
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := storagePacker.GetBucket(storagePacker.BucketPath(storagePacker.BucketKey("item1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find an item which lives in another bucket
+	var otherID string
+	for i := 0; otherID == ""; i++ {
+		id := fmt.Sprintf("item%d", i)
+		if storagePacker.BucketKey(id) != storagePacker.BucketKey("item1") {
+			otherID = id
+		}
+	}
+
+	// A bucket keyed where its items don't belong is refused
+	misKeyed := &Bucket{
+		Key:   storagePacker.BucketPath(storagePacker.BucketKey(otherID)),
+		Items: bucket.Items,
+	}
+	err = storagePacker.PutBucket(misKeyed)
+	if err == nil || !strings.Contains(err.Error(), `item "item1" belongs to bucket`) {
+		t.Fatalf("expected an error for a mis-keyed bucket, got %v", err)
+	}
+
+	for _, key := range []string{"256", "-1", "01", "foo"} {
+		err = storagePacker.PutBucket(&Bucket{
+			Key: storagePacker.BucketPath(key),
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid bucket key") {
+			t.Fatalf("expected an error for bucket key %q, got %v", key, err)
+		}
+	}
+
+	// Nothing was written under the mis-keyed bucket
+	fetched, err := storagePacker.GetBucket(misKeyed.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != nil {
+		t.Fatalf("bad: mis-keyed bucket was written: %#v", fetched)
+	}
+}
+
+func TestDistributionReport(t *testing.T) {
+	_, err := DistributionReport(nil)
+	if err == nil {
+		t.Fatal("expected an error for an empty ID set")
+	}
+
+	// Pick one ID per bucket, which is a perfectly even distribution
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[uint8]bool)
+	var evenIDs []string
+	for i := 0; len(evenIDs) < bucketCount; i++ {
+		id := fmt.Sprintf("item%d", i)
+		if index := storagePacker.BucketIndex(id); !seen[index] {
+			seen[index] = true
+			evenIDs = append(evenIDs, id)
+		}
+	}
+
+	report, err := DistributionReport(evenIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items != bucketCount || report.Min != 1 || report.Max != 1 || report.EmptyBuckets != 0 || report.Mean != 1 || report.StdDev != 0 {
+		t.Fatalf("bad: report: %#v", report)
+	}
+
+	// Repeating an ID places all of its occurrences in the same bucket
+	skewedIDs := make([]string, bucketCount)
+	for i := range skewedIDs {
+		skewedIDs[i] = "item0"
+	}
+
+	report, err = DistributionReport(skewedIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Min != 0 || report.Max != bucketCount || report.EmptyBuckets != bucketCount-1 || report.Mean != 1 {
+		t.Fatalf("bad: report: %#v", report)
+	}
+	if report.Counts[storagePacker.BucketIndex("item0")] != bucketCount {
+		t.Fatalf("bad: counts: %v", report.Counts)
+	}
+
+	// sqrt(((256-1)^2 + 255*(0-1)^2) / 256)
+	if expected := math.Sqrt(255); math.Abs(report.StdDev-expected) > 1e-9 {
+		t.Fatalf("bad: standard deviation; expected: %f, actual: %f", expected, report.StdDev)
+	}
+}
+
+func TestStoragePacker_WriteBatch(t *testing.T) {
+	storage := &countingStorage{Storage: &logical.InmemStorage{}}
+	storagePacker, err := NewStoragePacker(storage, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItem(&Item{ID: "existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Buffer a lot of changes, touching most buckets several times
+	touched := map[string]bool{
+		storagePacker.BucketKey("existing"): true,
+	}
+	batch := storagePacker.Begin(context.Background())
+	for i := 0; i < 1000; i++ {
+		err = batch.PutItem(&Item{ID: fmt.Sprintf("item%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		touched[storagePacker.BucketKey(fmt.Sprintf("item%d", i))] = true
+	}
+	err = batch.DeleteItem("item0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = batch.DeleteItem("existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written until the batch is committed
+	storage.reset()
+	item, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Fatal("buffered item should not be visible before commit")
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every touched bucket is written once
+	if storage.puts() != len(touched) {
+		t.Fatalf("expected %d writes, got %d", len(touched), storage.puts())
+	}
+
+	for i := 1; i < 1000; i++ {
+		item, err := storagePacker.GetItem(fmt.Sprintf("item%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Fatalf("item%d was not committed", i)
+		}
+	}
+	for _, id := range []string{"item0", "existing"} {
+		item, err := storagePacker.GetItem(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != nil {
+			t.Fatalf("%s should have been deleted", id)
+		}
+	}
+
+	if err := batch.PutItem(&Item{ID: "item0"}); err != ErrBatchDone {
+		t.Fatalf("expected ErrBatchDone, got %v", err)
+	}
+	if err := batch.Commit(); err != ErrBatchDone {
+		t.Fatalf("expected ErrBatchDone, got %v", err)
+	}
+
+	// Discarded changes are never written
+	batch = storagePacker.Begin(context.Background())
+	err = batch.PutItem(&Item{ID: "item0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.Discard()
+	if err := batch.Commit(); err != ErrBatchDone {
+		t.Fatalf("expected ErrBatchDone, got %v", err)
+	}
+
+	item, err = storagePacker.GetItem("item0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Fatal("discarded item should not have been written")
+	}
+}
+
+func TestStoragePacker_ItemGrowthThreshold(t *testing.T) {
+	var buf bytes.Buffer
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:                &logical.InmemStorage{},
+		Logger:              logformat.NewVaultLoggerWithWriter(&buf, log.LevelWarn),
+		ItemGrowthThreshold: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putEntity := func(name string) {
+		item, err := NewItem("item1", &identity.Entity{
+			ID:   "item1",
+			Name: name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storagePacker.PutItem(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Creating an item and growing it below the threshold is fine
+	putEntity("name")
+	putEntity(strings.Repeat("a", 50))
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning: %s", buf.String())
+	}
+
+	// Growing it beyond the threshold in a single update is reported
+	putEntity(strings.Repeat("a", 500))
+	if !strings.Contains(buf.String(), "item grew beyond threshold") || !strings.Contains(buf.String(), "item_id=item1") {
+		t.Fatalf("expected a growth warning; logs: %s", buf.String())
+	}
+
+	// Shrinking it is fine
+	buf.Reset()
+	putEntity("name")
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning: %s", buf.String())
+	}
+}
+
+func TestStoragePacker_WalkItemsBestEffort(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePacker(view, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Corrupt the bucket holding item0
+	corruptKey := storagePacker.BucketPath(storagePacker.BucketKey("item0"))
+	err = view.Put(context.Background(), &logical.StorageEntry{
+		Key:   corruptKey,
+		Value: []byte("garbage"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular walk aborts on the corrupt bucket
+	_, err = storagePacker.ListItemIDsWithPrefix(context.Background(), "")
+	if err == nil {
+		t.Fatal("expected an error listing a corrupt store")
+	}
+
+	var itemIDs []string
+	corrupt, err := storagePacker.WalkItemsBestEffort(context.Background(), func(item *Item) error {
+		itemIDs = append(itemIDs, item.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(corrupt) != 1 || corrupt[0].Key != corruptKey || corrupt[0].Err == nil {
+		t.Fatalf("bad: corrupt buckets: %#v", corrupt)
+	}
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("item%d", i)
+		if storagePacker.BucketPath(storagePacker.BucketKey(id)) != corruptKey {
+			expected = append(expected, id)
+		}
+	}
+	sort.Strings(expected)
+	sort.Strings(itemIDs)
+	if !reflect.DeepEqual(itemIDs, expected) {
+		t.Fatalf("bad: item IDs; expected: %v\nactual: %v", expected, itemIDs)
+	}
+}
+
+func TestStoragePacker_TrackTimestamps(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:            &logical.InmemStorage{},
+		TrackTimestamps: true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamps := func() (time.Time, time.Time) {
+		item, err := storagePacker.GetItem("item1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		creationTime, err := ptypes.Timestamp(item.CreationTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastUpdateTime, err := ptypes.Timestamp(item.LastUpdateTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return creationTime, lastUpdateTime
+	}
+
+	// The caller's item isn't stamped, only the stored copy
+	item := &Item{ID: "item1"}
+	err = storagePacker.PutItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.CreationTime != nil || item.LastUpdateTime != nil {
+		t.Fatalf("bad: item: %#v", item)
+	}
+
+	created := now
+	creationTime, lastUpdateTime := timestamps()
+	if !creationTime.Equal(created) || !lastUpdateTime.Equal(created) {
+		t.Fatalf("bad: creation time: %v, last update time: %v", creationTime, lastUpdateTime)
+	}
+
+	// Updating the item advances its last update time only
+	now = now.Add(time.Hour)
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creationTime, lastUpdateTime = timestamps()
+	if !creationTime.Equal(created) {
+		t.Fatalf("bad: creation time; expected: %v, actual: %v", created, creationTime)
+	}
+	if !lastUpdateTime.Equal(now) {
+		t.Fatalf("bad: last update time; expected: %v, actual: %v", now, lastUpdateTime)
+	}
+}
+
+func TestStoragePacker_NoTimestamps(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.CreationTime != nil || item.LastUpdateTime != nil {
+		t.Fatalf("items are stamped without TrackTimestamps: %#v", item)
+	}
+}
+
+func TestStoragePacker_CompareAndSwapItem(t *testing.T) {
+	storage := &countingStorage{Storage: &logical.InmemStorage{}}
+	storagePacker, err := NewStoragePacker(storage, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newItem := func(state string) *Item {
+		item, err := NewItem("item1", &identity.Entity{
+			ID:   "item1",
+			Name: state,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+
+	err = storagePacker.PutItem(newItem("pending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transition moves the item from one state to another
+	transition := func(from, to string) func(*Item) (bool, *Item) {
+		return func(current *Item) (bool, *Item) {
+			if current == nil {
+				return false, nil
+			}
+			var entity identity.Entity
+			if err := current.Decode(&entity); err != nil {
+				t.Fatal(err)
+			}
+			if entity.Name != from {
+				return false, nil
+			}
+			return true, newItem(to)
+		}
+	}
+
+	// The predicate rejects the swap based on the current state
+	storage.reset()
+	swapped, err := storagePacker.CompareAndSwapItem(context.Background(), "item1", transition("active", "revoked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Fatal("expected the swap to be rejected")
+	}
+	if storage.puts() != 0 {
+		t.Fatalf("expected no write, got %d", storage.puts())
+	}
+
+	swapped, err = storagePacker.CompareAndSwapItem(context.Background(), "item1", transition("pending", "active"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Fatal("expected the swap to happen")
+	}
+
+	item, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entity identity.Entity
+	if err := item.Decode(&entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Name != "active" {
+		t.Fatalf("bad: state: %q", entity.Name)
+	}
+
+	// Returning a nil item deletes it
+	swapped, err = storagePacker.CompareAndSwapItem(context.Background(), "item1", func(*Item) (bool, *Item) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !swapped {
+		t.Fatal("expected the swap to happen")
+	}
+	item, err = storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item != nil {
+		t.Fatal("expected the item to be deleted")
+	}
+
+	// Deleting an item which doesn't exist is not a swap
+	swapped, err = storagePacker.CompareAndSwapItem(context.Background(), "item1", func(*Item) (bool, *Item) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Fatal("expected no swap for a missing item")
+	}
+}
+
+func TestStoragePacker_MetricsPrefixLabel(t *testing.T) {
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(conf, inm); err != nil {
+		t.Fatal(err)
+	}
+
+	view := &logical.InmemStorage{}
+	for _, prefix := range []string{"entities/", "aliases/"} {
+		storagePacker, err := NewStoragePackerWithConfig(&Config{
+			View:                view,
+			ViewPrefix:          prefix,
+			ItemGrowthThreshold: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"a", strings.Repeat("a", 100)} {
+			item, err := NewItem("item1", &identity.Entity{Name: name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := storagePacker.PutItem(item); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	counters := make(map[string]metrics.SampledValue)
+	for _, intv := range inm.Data() {
+		intv.RLock()
+		for k, v := range intv.Counters {
+			counters[k] = v
+		}
+		intv.RUnlock()
+	}
+
+	for _, key := range []string{"storagepacker.item_growth;prefix=entities/", "storagepacker.item_growth;prefix=aliases/"} {
+		if counters[key].Count != 1 {
+			t.Fatalf("expected a single increment of %q; counters: %#v", key, counters)
+		}
+	}
+}
+
+func TestStoragePacker_RecordTombstones(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:             &logical.InmemStorage{},
+		RecordTombstones: true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"item1", "item2"} {
+		err = storagePacker.PutItem(&Item{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, deleted, err := storagePacker.GetDeletionTime(context.Background(), "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Fatal("item1 was not deleted yet")
+	}
+
+	now = now.Add(time.Hour)
+	err = storagePacker.DeleteItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deletionTime, deleted, err := storagePacker.GetDeletionTime(context.Background(), "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || !deletionTime.Equal(now) {
+		t.Fatalf("bad: deleted: %t, deletion time: %v", deleted, deletionTime)
+	}
+
+	// Deleting a missing item records nothing
+	err = storagePacker.DeleteItem("item3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, deleted, err = storagePacker.GetDeletionTime(context.Background(), "item3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Fatal("item3 never existed")
+	}
+
+	// Deletions through batches are recorded too
+	now = now.Add(time.Hour)
+	batch := storagePacker.Begin(context.Background())
+	if err := batch.DeleteItem("item2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	deletionTime, deleted, err = storagePacker.GetDeletionTime(context.Background(), "item2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || !deletionTime.Equal(now) {
+		t.Fatalf("bad: deleted: %t, deletion time: %v", deleted, deletionTime)
+	}
+
+	// The tombstones aren't mistaken for buckets
+	itemIDs, err := storagePacker.ListItemIDsWithPrefix(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itemIDs) != 0 {
+		t.Fatalf("bad: item IDs: %v", itemIDs)
+	}
+}
+
+// bucketFailingStorage fails the writes of buckets while failBuckets is set
+type bucketFailingStorage struct {
+	logical.Storage
+
+	l           sync.Mutex
+	failBuckets bool
+}
+
+func (f *bucketFailingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	f.l.Lock()
+	fail := f.failBuckets
+	f.l.Unlock()
+
+	if fail && !strings.Contains(entry.Key, tombstonesPrefix) {
+		return fmt.Errorf("storage unavailable")
+	}
+	return f.Storage.Put(ctx, entry)
+}
+
+func (f *bucketFailingStorage) setFailBuckets(fail bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.failBuckets = fail
+}
+
+func TestStoragePacker_RecordTombstonesRollback(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &bucketFailingStorage{Storage: &logical.InmemStorage{}}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:             storage,
+		RecordTombstones: true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// item1 was deleted once already, item2 never was
+	for _, id := range []string{"item1", "item2"} {
+		err = storagePacker.PutItem(&Item{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = storagePacker.DeleteItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted1 := now
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A deletion whose bucket write fails reverts the tombstones it recorded
+	now = now.Add(time.Hour)
+	storage.setFailBuckets(true)
+	for _, id := range []string{"item1", "item2"} {
+		if err := storagePacker.DeleteItem(id); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	storage.setFailBuckets(false)
+
+	deletionTime, deleted, err := storagePacker.GetDeletionTime(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || !deletionTime.Equal(deleted1) {
+		t.Fatalf("bad: deleted: %t, deletion time: %v", deleted, deletionTime)
+	}
+
+	_, deleted, err = storagePacker.GetDeletionTime(ctx, "item2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Fatal("item2 was not deleted")
+	}
+}
+
+func TestStoragePacker_ApproximateTotalSize(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:         view,
+		IndexBuckets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		item, err := NewItem(fmt.Sprintf("item%d", i), &identity.Entity{
+			Name: strings.Repeat("a", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storagePacker.PutItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := storagePacker.DeleteItem(fmt.Sprintf("item%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exactSize := func() int64 {
+		keys, err := storagePacker.listBucketKeys(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, key := range keys {
+			entry, err := view.Get(context.Background(), storagePacker.BucketPath(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := storagePacker.GetBucket(storagePacker.BucketPath(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bucket.Items) != 0 {
+				total += int64(len(entry.Value))
+			}
+		}
+		return total
+	}
+
+	approximate, err := storagePacker.ApproximateTotalSize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exact := exactSize(); approximate != exact {
+		t.Fatalf("bad: approximate size; expected: %d, actual: %d", exact, approximate)
+	}
+
+	// A reopened packer relies on the persisted sizes, which may lag
+	// updates of already indexed buckets
+	reopened, err := NewStoragePackerWithConfig(&Config{
+		View:         view,
+		IndexBuckets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	approximate, err = reopened.ApproximateTotalSize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exact := exactSize(); approximate <= 0 || math.Abs(float64(approximate-exact)) > 0.5*float64(exact) {
+		t.Fatalf("bad: approximate size %d too far from %d", approximate, exact)
+	}
+
+	// The size can't be approximated without the bucket index
+	storagePacker, err = NewStoragePacker(view, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storagePacker.ApproximateTotalSize(context.Background()); err == nil {
+		t.Fatal("expected an error without the bucket index")
+	}
+}
+
+func TestStoragePacker_DefaultConfig(t *testing.T) {
+	view := &logical.InmemStorage{}
+
+	for _, prefix := range []string{"", "entities", "aliases/"} {
+		config := DefaultConfig(view, prefix)
+
+		storagePacker, err := NewStoragePackerWithConfig(&Config{
+			View:       view,
+			ViewPrefix: prefix,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied := storagePacker.config
+
+		if config.View != applied.View || config.ViewPrefix != applied.ViewPrefix || config.Logger != applied.Logger {
+			t.Fatalf("bad: default config: %#v\nconstructor config: %#v", config, applied)
+		}
+		if !reflect.DeepEqual(config.ItemCodec, applied.ItemCodec) {
+			t.Fatalf("bad: item codec; expected: %#v, actual: %#v", applied.ItemCodec, config.ItemCodec)
+		}
+		if config.Clock == nil || applied.Clock == nil {
+			t.Fatal("expected a clock")
+		}
+
+		// The resolved defaults are used as-is by the constructor
+		storagePacker, err = NewStoragePackerWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if storagePacker.viewPrefix != config.ViewPrefix {
+			t.Fatalf("bad: view prefix; expected: %q, actual: %q", config.ViewPrefix, storagePacker.viewPrefix)
+		}
+	}
+
+	if prefix := DefaultConfig(view, "").ViewPrefix; prefix != StoragePackerBucketsPrefix {
+		t.Fatalf("bad: default view prefix: %q", prefix)
+	}
+	if prefix := DefaultConfig(view, "entities").ViewPrefix; prefix != "entities/" {
+		t.Fatalf("bad: view prefix: %q", prefix)
+	}
+}
+
+func TestStoragePacker_WalkItemsSorted(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.New("storagepackertest"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for i := 0; i < 50; i++ {
+		expected = append(expected, fmt.Sprintf("item%02d", i))
+	}
+
+	// Insert in reverse order
+	for i := len(expected) - 1; i >= 0; i-- {
+		err = storagePacker.PutItem(&Item{ID: expected[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var actual []string
+	err = storagePacker.WalkItemsSorted(context.Background(), func(item *Item) error {
+		actual = append(actual, item.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bad: visitation order; expected: %v\nactual: %v", expected, actual)
+	}
+}
+
+// failingStorage fails every Put, counting the attempts
+type failingStorage struct {
+	logical.Storage
+
+	l     sync.Mutex
+	nPuts int
+}
+
+func (f *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	f.nPuts++
+	return fmt.Errorf("storage unavailable")
+}
+
+func (f *failingStorage) puts() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	return f.nPuts
+}
+
+func TestStoragePacker_SecondaryView(t *testing.T) {
+	primary := &logical.InmemStorage{}
+	secondary := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:          primary,
+		SecondaryView: secondary,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storagePacker.Close()
+
+	for i := 0; i < 10; i++ {
+		err = storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The secondary eventually holds the same bucket bytes
+	bucketPath := storagePacker.BucketPath(storagePacker.BucketKey("item9"))
+	expected, err := primary.Get(context.Background(), bucketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mirrored, err := secondary.Get(context.Background(), bucketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mirrored != nil && bytes.Equal(mirrored.Value, expected.Value) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bucket to be mirrored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A failing secondary doesn't fail the primary
+	failing := &failingStorage{Storage: &logical.InmemStorage{}}
+	storagePacker, err = NewStoragePackerWithConfig(&Config{
+		View:          &logical.InmemStorage{},
+		SecondaryView: failing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storagePacker.Close()
+
+	err = storagePacker.PutItem(&Item{ID: "item1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := storagePacker.GetItem("item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil {
+		t.Fatal("expected the item to be stored in the primary")
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for failing.puts() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the mirror attempt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStoragePacker_SecondaryViewClose(t *testing.T) {
+	primary := &logical.InmemStorage{}
+	secondary := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:          primary,
+		SecondaryView: secondary,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writes still queued are mirrored before Close returns
+	err = storagePacker.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := logical.CollectKeys(context.Background(), primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		expected, err := primary.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirrored, err := secondary.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mirrored == nil || !bytes.Equal(mirrored.Value, expected.Value) {
+			t.Fatalf("bucket %q was not mirrored", key)
+		}
+	}
+}
+
+func TestStoragePacker_CompressionMinSize(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:               view,
+		CompressionMinSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putEntity := func(id, name string) {
+		item, err := NewItem(id, &identity.Entity{ID: id, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storagePacker.PutItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Find two items living in different buckets
+	small, large := "item0", ""
+	for i := 1; large == ""; i++ {
+		id := fmt.Sprintf("item%d", i)
+		if storagePacker.BucketKey(id) != storagePacker.BucketKey(small) {
+			large = id
+		}
+	}
+	putEntity(small, "small")
+	putEntity(large, strings.Repeat("large", 200))
+
+	for _, tc := range []struct {
+		id         string
+		compressed bool
+	}{
+		{small, false},
+		{large, true},
+	} {
+		entry, err := view.Get(context.Background(), storagePacker.BucketPath(storagePacker.BucketKey(tc.id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := entry.Value[0] == compressutil.CompressionCanarySnappy; compressed != tc.compressed {
+			t.Fatalf("bad: bucket of %q compressed: %t", tc.id, compressed)
+		}
+
+		item, err := storagePacker.GetItem(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Fatalf("failed to read back %q", tc.id)
+		}
+	}
+
+	_, err = NewStoragePackerWithConfig(&Config{
+		View:               view,
+		CompressionMinSize: -1,
+	})
+	if err == nil {
+		t.Fatal("expected an error for a negative compression min size")
+	}
+}
+
+func TestStoragePacker_PrimaryIndexFunc(t *testing.T) {
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View: view,
+		PrimaryIndexFunc: func(string) uint8 {
+			return 42
+		},
+		StrictKeyValidation: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err = storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All the items live in the same bucket
+	keys, err := storagePacker.listBucketKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"42"}) {
+		t.Fatalf("bad: bucket keys: %v", keys)
+	}
+
+	for i := 0; i < 20; i++ {
+		item, err := storagePacker.GetItem(fmt.Sprintf("item%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Fatalf("item%d is not retrievable", i)
+		}
+	}
+
+	err = storagePacker.DeleteItem("item0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storagePacker.GetBucket(storagePacker.BucketPath("42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bucket.Items) != 19 {
+		t.Fatalf("expected 19 items, got %d", len(bucket.Items))
+	}
+}
+
+func TestStoragePacker_MergeFrom(t *testing.T) {
+	ctx := context.Background()
+
+	dst, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use a different bucketing for the source to make sure items are
+	// rehashed when merged
+	src, err := NewStoragePackerWithConfig(&Config{
+		View: &logical.InmemStorage{},
+		PrimaryIndexFunc: func(string) uint8 {
+			return 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(s *StoragePacker, id, value string) {
+		item, err := NewItem(id, &identity.Entity{ID: id, Name: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := func(s *StoragePacker, id string) string {
+		item, err := s.GetItem(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Fatalf("item %q not found", id)
+		}
+		var entity identity.Entity
+		if err := item.Decode(&entity); err != nil {
+			t.Fatal(err)
+		}
+		return entity.Name
+	}
+
+	put(dst, "shared", "a")
+	put(dst, "dst-only", "a")
+	put(src, "shared", "bb")
+	put(src, "src-only", "bb")
+
+	conflicts, err := dst.MergeFrom(ctx, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"shared"}) {
+		t.Fatalf("bad: conflicts: %v", conflicts)
+	}
+	if name(dst, "shared") != "a" {
+		t.Fatal("conflicting item was overwritten")
+	}
+	if name(dst, "src-only") != "bb" || name(dst, "dst-only") != "a" {
+		t.Fatal("bad: merged items")
+	}
+
+	conflicts, err = dst.MergeFrom(ctx, src, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"shared", "src-only"}) {
+		t.Fatalf("bad: conflicts: %v", conflicts)
+	}
+	if name(dst, "shared") != "bb" {
+		t.Fatal("conflicting item was not overwritten")
+	}
+
+	// The source is left untouched
+	if name(src, "shared") != "bb" {
+		t.Fatal("source packer was modified")
+	}
+	if item, err := src.GetItem("dst-only"); err != nil || item != nil {
+		t.Fatalf("bad: item: %v, err: %v", item, err)
+	}
+}
+
+func TestStoragePacker_MaxItemsPerPrimary(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:               &logical.InmemStorage{},
+		MaxItemsPerPrimary: 3,
+		PrimaryIndexFunc: func(itemID string) uint8 {
+			if strings.HasPrefix(itemID, "full") {
+				return 1
+			}
+			return 2
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = storagePacker.PutItem(&Item{ID: fmt.Sprintf("full%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storagePacker.PutItem(&Item{ID: "full3"})
+	if err != ErrPrimaryBucketFull {
+		t.Fatalf("expected ErrPrimaryBucketFull, got %v", err)
+	}
+
+	// Existing items can still be updated
+	err = storagePacker.PutItem(&Item{ID: "full0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other buckets are not affected
+	err = storagePacker.PutItem(&Item{ID: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit also applies to swaps and batches
+	_, err = storagePacker.CompareAndSwapItem(context.Background(), "full3", func(*Item) (bool, *Item) {
+		return true, &Item{ID: "full3"}
+	})
+	if err != ErrPrimaryBucketFull {
+		t.Fatalf("expected ErrPrimaryBucketFull, got %v", err)
+	}
+
+	batch := storagePacker.Begin(context.Background())
+	if err := batch.PutItem(&Item{ID: "full4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, err := NewStoragePackerWithConfig(&Config{
+		View:               &logical.InmemStorage{},
+		MaxItemsPerPrimary: -1,
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_PrimaryBucketKey(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find two IDs sharing a bucket
+	first := "item0"
+	second := ""
+	for i := 1; second == ""; i++ {
+		id := fmt.Sprintf("item%d", i)
+		if storagePacker.BucketIndex(id) == storagePacker.BucketIndex(first) {
+			second = id
+		}
+	}
+
+	firstKey, err := storagePacker.PrimaryBucketKey(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := storagePacker.PrimaryBucketKey(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstKey != secondKey {
+		t.Fatalf("expected the same key, got %q and %q", firstKey, secondKey)
+	}
+
+	// The key is the one the item is stored under
+	if err := storagePacker.PutItem(&Item{ID: first}); err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storagePacker.GetBucket(firstKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket == nil || bucket.findItem(first) == nil {
+		t.Fatalf("item not found in bucket %q", firstKey)
+	}
+
+	if _, err := storagePacker.PrimaryBucketKey(""); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_PutBucketUnchecked(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:         view,
+		IndexBuckets: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := &Bucket{
+		Key:   "staging/12",
+		Items: []*Item{{ID: "item1"}},
+	}
+
+	// The public API rejects keys outside of the view prefix
+	if err := storagePacker.PutBucket(staged); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if err := storagePacker.putBucketUnchecked(ctx, staged, 0); err != nil {
+		t.Fatal(err)
+	}
+	if staged.Version != 1 {
+		t.Fatalf("expected version 1, got %d", staged.Version)
+	}
+
+	bucket, err := storagePacker.GetBucket("staging/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket == nil || bucket.findItem("item1") == nil {
+		t.Fatalf("bad: staged bucket: %v", bucket)
+	}
+
+	// Staged buckets are not part of the packer's buckets
+	keys, err := storagePacker.bucketKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("bad: bucket keys: %v", keys)
+	}
+
+	if err := storagePacker.putBucketUnchecked(ctx, &Bucket{}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_DeleteItemExisted(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storagePacker.PutItem(&Item{ID: "item1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	existed, err := storagePacker.DeleteItemExisted(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existed {
+		t.Fatal("expected the item to exist")
+	}
+
+	// Deleting it again reports it missing
+	existed, err = storagePacker.DeleteItemExisted(ctx, "item1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existed {
+		t.Fatal("expected the item not to exist")
+	}
+
+	// As does deleting from a bucket which was never written
+	existed, err = storagePacker.DeleteItemExisted(ctx, "never-stored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existed {
+		t.Fatal("expected the item not to exist")
+	}
+}
+
+// storageClassStorage is an in-memory view recording the storage class hints
+// it receives
+type storageClassStorage struct {
+	logical.InmemStorage
+
+	l       sync.Mutex
+	classes map[string]string
+}
+
+func (s *storageClassStorage) PutWithStorageClass(ctx context.Context, entry *logical.StorageEntry, storageClass string) error {
+	s.l.Lock()
+	if s.classes == nil {
+		s.classes = make(map[string]string)
+	}
+	s.classes[entry.Key] = storageClass
+	s.l.Unlock()
+
+	return s.Put(ctx, entry)
+}
+
+func TestStoragePacker_PutItemWithOptions(t *testing.T) {
+	ctx := context.Background()
+	view := &storageClassStorage{}
+	storagePacker, err := NewStoragePacker(view, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "cold"}, &PutItemOptions{
+		StorageClass: "archive",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucketKey, err := storagePacker.PrimaryBucketKey("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.classes[bucketKey] != "archive" {
+		t.Fatalf("expected the hint to be forwarded, got %v", view.classes)
+	}
+
+	item, err := storagePacker.GetItem("cold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil {
+		t.Fatal("item not found")
+	}
+
+	// Writes without a hint don't go through the hinting interface
+	if err := storagePacker.PutItem(&Item{ID: "hot"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(view.classes) != 1 {
+		t.Fatalf("bad: hints: %v", view.classes)
+	}
+
+	// Views without hint support ignore the hint
+	var buf bytes.Buffer
+	plainPacker, err := NewStoragePacker(&logical.InmemStorage{}, logformat.NewVaultLoggerWithWriter(&buf, log.LevelTrace), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = plainPacker.PutItemWithOptions(ctx, &Item{ID: "cold"}, &PutItemOptions{
+		StorageClass: "archive",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "ignoring hint") {
+		t.Fatalf("expected a debug log; logs: %s", buf.String())
+	}
+}
+
+func TestStoragePacker_IncrementCounter(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := storagePacker.IncrementCounter(ctx, "counter", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 5 {
+		t.Fatalf("expected 5, got %d", value)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := storagePacker.IncrementCounter(ctx, "counter", 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err = storagePacker.IncrementCounter(ctx, "counter", -5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 100 {
+		t.Fatalf("expected 100, got %d", value)
+	}
+
+	item, err := storagePacker.GetItem("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter Counter
+	if err := item.Decode(&counter); err != nil {
+		t.Fatal(err)
+	}
+	if counter.Value != 100 {
+		t.Fatalf("expected a stored value of 100, got %d", counter.Value)
+	}
+
+	// Items which are not counters are left alone
+	entity, err := NewItem("entity", &identity.Entity{ID: "entity", Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(entity); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storagePacker.IncrementCounter(ctx, "entity", 1); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_ListLargeItems(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[string]int{
+		"small1": 10,
+		"small2": 20,
+		"large1": 2000,
+		"large2": 5000,
+	}
+	for id, size := range sizes {
+		item, err := NewItem(id, &identity.Entity{ID: id, Name: strings.Repeat("x", size)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storagePacker.PutItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	large, err := storagePacker.ListLargeItems(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(large) != 2 || large[0].ID != "large2" || large[1].ID != "large1" {
+		t.Fatalf("bad: large items: %v", large)
+	}
+	if large[0].Size <= 5000 || large[1].Size <= 2000 || large[1].Size > large[0].Size {
+		t.Fatalf("bad: sizes: %v", large)
+	}
+}
+
+func TestStoragePacker_RehashAll(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+
+	oldPacker, err := NewStoragePacker(view, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var itemIDs []string
+	for i := 0; i < 100; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+		itemIDs = append(itemIDs, itemID)
+		if err := oldPacker.PutItem(&Item{ID: itemID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newHash := func(itemID string) uint8 {
+		return uint8(len(itemID))
+	}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:             view,
+		PrimaryIndexFunc: newHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an interrupted earlier run, which copied an item to its new
+	// bucket without removing it from its old one
+	if err := storagePacker.PutItem(&Item{ID: "item42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storagePacker.RehashAll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, itemID := range itemIDs {
+		item, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil {
+			t.Fatalf("item %q not found after rehashing", itemID)
+		}
+	}
+
+	// Only the buckets of the new hash are left, and items aren't duplicated
+	keys, err := storagePacker.listBucketKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"5", "6"}) {
+		t.Fatalf("bad: bucket keys: %v", keys)
+	}
+	count := 0
+	for _, key := range keys {
+		bucket, err := storagePacker.GetBucket(storagePacker.BucketPath(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(bucket.Items)
+	}
+	if count != len(itemIDs) {
+		t.Fatalf("expected %d items, got %d", len(itemIDs), count)
+	}
+
+	// Running it again is a no-op
+	if err := storagePacker.RehashAll(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoragePacker_MaxItemIDLength(t *testing.T) {
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:            &logical.InmemStorage{},
+		MaxItemIDLength: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longID := strings.Repeat("x", 17)
+
+	if err := storagePacker.PutItem(&Item{ID: longID}); err != ErrItemIDTooLong {
+		t.Fatalf("expected ErrItemIDTooLong, got %v", err)
+	}
+	if _, err := storagePacker.GetItem(longID); err != ErrItemIDTooLong {
+		t.Fatalf("expected ErrItemIDTooLong, got %v", err)
+	}
+	if err := storagePacker.DeleteItem(longID); err != ErrItemIDTooLong {
+		t.Fatalf("expected ErrItemIDTooLong, got %v", err)
+	}
+	if err := storagePacker.Begin(context.Background()).PutItem(&Item{ID: longID}); err != ErrItemIDTooLong {
+		t.Fatalf("expected ErrItemIDTooLong, got %v", err)
+	}
+
+	// IDs up to the limit are fine
+	if err := storagePacker.PutItem(&Item{ID: longID[1:]}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := storagePacker.GetItem(longID[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil {
+		t.Fatal("item not found")
+	}
+}
+
+func TestStoragePacker_TombstoneMatching(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:             &logical.InmemStorage{},
+		RecordTombstones: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 40; i++ {
+		if err := storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tombstone the items whose ID ends with 0, 1 or 2
+	match := func(item *Item) bool {
+		return strings.ContainsAny(item.ID[len(item.ID)-1:], "012")
+	}
+	count, err := storagePacker.TombstoneMatching(ctx, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 12 {
+		t.Fatalf("expected 12 tombstoned items, got %d", count)
+	}
+
+	for i := 0; i < 40; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+		item, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, deleted, err := storagePacker.GetDeletionTime(ctx, itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched := match(&Item{ID: itemID})
+		if matched != (item == nil) || matched != deleted {
+			t.Fatalf("bad: item %q: matched: %t, found: %t, tombstoned: %t", itemID, matched, item != nil, deleted)
+		}
+	}
+
+	// Nothing is left to match
+	count, err = storagePacker.TombstoneMatching(ctx, match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no tombstoned items, got %d", count)
+	}
+
+	// Tombstones must be enabled
+	plainPacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plainPacker.TombstoneMatching(ctx, match); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_ValidateStore(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePacker(view, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := storagePacker.PutItem(&Item{ID: fmt.Sprintf("item%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storagePacker.ValidateStore(ctx, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.ValidateStore(ctx, 0); err == nil {
+		t.Fatal("expected an error for an empty sample")
+	}
+
+	// Corrupt the bucket holding item0, which a full sample includes
+	corruptKey := storagePacker.BucketPath(storagePacker.BucketKey("item0"))
+	err = view.Put(ctx, &logical.StorageEntry{
+		Key:   corruptKey,
+		Value: []byte("garbage"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storagePacker.ValidateStore(ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), corruptKey) {
+		t.Fatalf("expected an error naming %q, got %v", corruptKey, err)
+	}
+
+	// Items with undecodable timestamps are detected too
+	err = storagePacker.PutBucket(&Bucket{
+		Key: corruptKey,
+		Items: []*Item{
+			{
+				ID:             "item0",
+				LastUpdateTime: &timestamp.Timestamp{Nanos: -1},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storagePacker.ValidateStore(ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), "last update time") {
+		t.Fatalf("expected an invalid timestamp error, got %v", err)
+	}
+}
+
+func TestStoragePacker_ExportImportPrimary(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:            &logical.InmemStorage{},
+		TrackTimestamps: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var itemIDs []string
+	for i := 0; i < 1000; i++ {
+		itemID := fmt.Sprintf("item%d", i)
+		itemIDs = append(itemIDs, itemID)
+		if err := storagePacker.PutItem(&Item{ID: itemID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucketKey := storagePacker.BucketKey("item0")
+	var buf bytes.Buffer
+	if err := storagePacker.ExportPrimary(ctx, bucketKey, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ImportPrimary(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := 0
+	for _, itemID := range itemIDs {
+		item, err := restored.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if storagePacker.BucketKey(itemID) != bucketKey {
+			if item != nil {
+				t.Fatalf("item %q from another bucket was restored", itemID)
+			}
+			continue
+		}
+		exported++
+
+		if item == nil {
+			t.Fatalf("item %q was not restored", itemID)
+		}
+		original, err := storagePacker.GetItem(itemID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(item, original) {
+			t.Fatalf("bad: restored item: %v, original: %v", item, original)
+		}
+	}
+	if exported < 2 {
+		t.Fatalf("expected several items in the exported bucket, got %d", exported)
+	}
+
+	if err := storagePacker.ExportPrimary(ctx, "256", &buf); err == nil {
+		t.Fatal("expected an error for an invalid bucket key")
+	}
+}
+
+func TestStoragePacker_FindDuplicatePayloads(t *testing.T) {
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := map[string]string{
+		"item1": "same",
+		"item2": "same",
+		"item3": "other",
+		"item4": "unique",
+		"item5": "other",
+	}
+	for id, name := range payloads {
+		item, err := NewItem(id, &identity.Entity{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storagePacker.PutItem(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Items without a payload are ignored
+	for _, id := range []string{"empty1", "empty2"} {
+		if err := storagePacker.PutItem(&Item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := storagePacker.FindDuplicatePayloads(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found [][]string
+	for _, itemIDs := range groups {
+		found = append(found, itemIDs)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i][0] < found[j][0]
+	})
+	expected := [][]string{{"item1", "item2"}, {"item3", "item5"}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("bad: groups: %v", groups)
+	}
+}
+
+func TestStoragePacker_ItemValidator(t *testing.T) {
+	view := &countingStorage{Storage: &logical.InmemStorage{}}
+	errMissingName := errors.New("entity has no name")
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View: view,
+		ItemValidator: func(item *Item) error {
+			var entity identity.Entity
+			if err := item.Decode(&entity); err != nil {
+				return err
+			}
+			if entity.Name == "" {
+				return errMissingName
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid, err := NewItem("invalid", &identity.Entity{ID: "invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(invalid); err != errMissingName {
+		t.Fatalf("expected the validator error, got %v", err)
+	}
+	if err := storagePacker.Begin(context.Background()).PutItem(invalid); err != errMissingName {
+		t.Fatalf("expected the validator error, got %v", err)
+	}
+	_, err = storagePacker.CompareAndSwapItem(context.Background(), "invalid", func(*Item) (bool, *Item) {
+		return true, invalid
+	})
+	if err != errMissingName {
+		t.Fatalf("expected the validator error, got %v", err)
+	}
+	if view.puts() != 0 {
+		t.Fatalf("expected no writes, got %d", view.puts())
+	}
+
+	valid, err := NewItem("valid", &identity.Entity{ID: "valid", Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PutItem(valid); err != nil {
+		t.Fatal(err)
+	}
+	if view.puts() == 0 {
+		t.Fatal("expected the valid item to be written")
+	}
+}
+
+func TestStoragePacker_AsStorage(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var storage logical.Storage = storagePacker.AsStorage()
+
+	entries := map[string]string{
+		"foo":         "1",
+		"bar/baz":     "2",
+		"bar/qux":     "3",
+		"bar/deep/er": "4",
+	}
+	for key, value := range entries {
+		if err := storage.Put(ctx, &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, value := range entries {
+		entry, err := storage.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.Key != key || string(entry.Value) != value {
+			t.Fatalf("bad: entry for %q: %#v", key, entry)
+		}
+	}
+
+	keys, err := storage.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"bar/", "foo"}) {
+		t.Fatalf("bad: keys: %v", keys)
+	}
+	keys, err = storage.List(ctx, "bar/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"baz", "deep/", "qux"}) {
+		t.Fatalf("bad: keys: %v", keys)
+	}
+
+	if err := storage.Delete(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := storage.Get(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry != nil {
+		t.Fatalf("expected no entry, got %#v", entry)
+	}
+
+	// The entries are regular items of the packer
+	item, err := storagePacker.GetItem("bar/baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.Message.TypeUrl != RawItemTypeURL {
+		t.Fatalf("bad: item: %v", item)
+	}
+
+	// Items not written through the adapter can't be read through it
+	if err := storagePacker.PutItem(&Item{ID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get(ctx, "other"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestStoragePacker_SplitPayload(t *testing.T) {
+	ctx := context.Background()
+	view := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePacker(view, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := &any.Any{TypeUrl: "test", Value: []byte("large payload")}
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bucket holds the header only
+	bucketKey, err := storagePacker.PrimaryBucketKey("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storagePacker.GetBucket(bucketKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := bucket.findItem("split")
+	if stored == nil || stored.Message != nil || stored.PayloadKey == "" {
+		t.Fatalf("expected a header in the bucket, got %#v", stored)
+	}
+
+	header, err := storagePacker.GetItemHeader("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.Message != nil || header.PayloadKey != stored.PayloadKey {
+		t.Fatalf("bad: header: %#v", header)
+	}
+
+	item, err := storagePacker.GetItem("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || !proto.Equal(item.Message, payload) {
+		t.Fatalf("bad: item: %#v", item)
+	}
+
+	// Overwriting the item releases its previous payload
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := view.List(ctx, StoragePackerBucketsPrefix+payloadsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || payloadsPrefix+keys[0] == stored.PayloadKey {
+		t.Fatalf("expected only the new payload to be stored, got %v", keys)
+	}
+
+	// Storing the item whole releases its payload too
+	if err := storagePacker.PutItem(&Item{ID: "split", Message: payload}); err != nil {
+		t.Fatal(err)
+	}
+	header, err = storagePacker.GetItemHeader("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.PayloadKey != "" || !proto.Equal(header.Message, payload) {
+		t.Fatalf("expected the item to be stored whole, got %#v", header)
+	}
+	keys, err = view.List(ctx, StoragePackerBucketsPrefix+payloadsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no payloads, got %v", keys)
+	}
+
+	// Deleting the item deletes its payload
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.DeleteItem("split"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = view.List(ctx, StoragePackerBucketsPrefix+payloadsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no payloads, got %v", keys)
+	}
+
+	// Purging removes the payloads left behind
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storagePacker.PurgeAll(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = view.List(ctx, StoragePackerBucketsPrefix+payloadsPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected no payloads, got %v", keys)
+	}
+}
+
+func TestStoragePacker_SplitPayload_SecondaryView(t *testing.T) {
+	ctx := context.Background()
+	secondary := &logical.InmemStorage{}
+	storagePacker, err := NewStoragePackerWithConfig(&Config{
+		View:          &logical.InmemStorage{},
+		SecondaryView: secondary,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := &any.Any{TypeUrl: "test", Value: []byte("large payload")}
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close mirrors the queued writes
+	if err := storagePacker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mirror holds the payload the header refers to
+	standby, err := NewStoragePacker(secondary, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := standby.GetItem("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.PayloadKey == "" || !proto.Equal(item.Message, payload) {
+		t.Fatalf("bad: mirrored item: %#v", item)
+	}
+}
+
+func TestStoragePacker_SplitPayload_ExportImportPrimary(t *testing.T) {
+	ctx := context.Background()
+	storagePacker, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := &any.Any{TypeUrl: "test", Value: []byte("large payload")}
+	err = storagePacker.PutItemWithOptions(ctx, &Item{ID: "split", Message: payload}, &PutItemOptions{
+		SplitPayload: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := storagePacker.ExportPrimary(ctx, storagePacker.BucketKey("split"), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The snapshot doesn't depend on the payload still being stored
+	if err := storagePacker.DeleteItem("split"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewStoragePacker(&logical.InmemStorage{}, log.NullLog, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ImportPrimary(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := restored.GetItemHeader("split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || item.PayloadKey != "" || !proto.Equal(item.Message, payload) {
+		t.Fatalf("expected the item to be restored whole, got %#v", item)
+	}
+}
@@ -0,0 +1,218 @@
+package storagepacker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// tombstonesPrefix is the prefix, relative to the view prefix, under which
+// the tombstones of deleted items are stored when Config.RecordTombstones is
+// set. Keys starting with an underscore are reserved by the packer.
+const tombstonesPrefix = "_tombstones/"
+
+// tombstoneEntry is the persisted form of a tombstone
+type tombstoneEntry struct {
+	DeletionTime time.Time `json:"deletion_time"`
+}
+
+// Tombstones record when items were deleted, in a storage entry per item ID
+// kept apart from the buckets, so that deletions can be audited without
+// reading any bucket.
+//
+// A tombstone is written before the bucket from which the item is removed,
+// and is reverted to the tombstone of the previous deletion, if any, if
+// writing the bucket fails, so that an item is never deleted without a
+// record of it. Tombstones are not removed when an item is created again,
+// nor by PurgeAll; GetDeletionTime reports the last time an item was deleted.
+
+// putBucketRemovingItems stores the bucket from which the items with the
+// given IDs were removed, recording their tombstones if enabled. storedVersion
+// is as for putBucket.
+func (s *StoragePacker) putBucketRemovingItems(ctx context.Context, bucket *Bucket, storedVersion uint64, removedIDs []string) error {
+	if !s.config.RecordTombstones || len(removedIDs) == 0 {
+		return s.putBucket(ctx, bucket, storedVersion)
+	}
+
+	value, err := jsonutil.EncodeJSON(&tombstoneEntry{
+		DeletionTime: s.now().UTC(),
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to encode tombstone: {{err}}", err)
+	}
+
+	var recorded []recordedTombstone
+	for _, itemID := range removedIDs {
+		key := s.viewPrefix + tombstonesPrefix + itemID
+
+		// The tombstone of an earlier deletion is kept so that it can be
+		// put back if this deletion doesn't happen
+		previous, err := s.view.Get(ctx, key)
+		if err != nil {
+			s.restoreTombstones(ctx, recorded)
+			return errwrap.Wrapf("failed to read tombstone: {{err}}", err)
+		}
+
+		err = s.view.Put(ctx, &logical.StorageEntry{
+			Key:   key,
+			Value: value,
+		})
+		if err != nil {
+			s.restoreTombstones(ctx, recorded)
+			return errwrap.Wrapf("failed to persist tombstone: {{err}}", err)
+		}
+		recorded = append(recorded, recordedTombstone{
+			key:      key,
+			previous: previous,
+		})
+	}
+
+	err = s.putBucket(ctx, bucket, storedVersion)
+	if err != nil {
+		s.restoreTombstones(ctx, recorded)
+		return err
+	}
+
+	return nil
+}
+
+// recordedTombstone is a tombstone written for a deletion, along with the
+// tombstone it replaced, which is nil if the item was never deleted before
+type recordedTombstone struct {
+	key      string
+	previous *logical.StorageEntry
+}
+
+// restoreTombstones reverts the given tombstones, which were recorded for
+// deletions which didn't happen, to the tombstones they replaced. Failures
+// are only logged, since the original error matters more to the caller.
+func (s *StoragePacker) restoreTombstones(ctx context.Context, recorded []recordedTombstone) {
+	for _, tombstone := range recorded {
+		var err error
+		if tombstone.previous != nil {
+			err = s.view.Put(ctx, tombstone.previous)
+		} else {
+			err = s.view.Delete(ctx, tombstone.key)
+		}
+		if err != nil {
+			s.logger.Error("storagepacker: failed to restore tombstone", "key", tombstone.key, "error", err)
+		}
+	}
+}
+
+// GetDeletionTime returns the last time the item with the given ID was
+// deleted, and whether it was ever deleted since tombstones are recorded.
+// Tombstones are only recorded if Config.RecordTombstones is set.
+func (s *StoragePacker) GetDeletionTime(ctx context.Context, itemID string) (time.Time, bool, error) {
+	if err := s.checkClosed(); err != nil {
+		return time.Time{}, false, err
+	}
+
+	if itemID == "" {
+		return time.Time{}, false, errors.New("empty item ID")
+	}
+
+	entry, err := s.view.Get(ctx, s.viewPrefix+tombstonesPrefix+itemID)
+	if err != nil {
+		return time.Time{}, false, errwrap.Wrapf("failed to read tombstone: {{err}}", err)
+	}
+	if entry == nil {
+		return time.Time{}, false, nil
+	}
+
+	var tombstone tombstoneEntry
+	err = jsonutil.DecodeJSON(entry.Value, &tombstone)
+	if err != nil {
+		return time.Time{}, false, errwrap.Wrapf("failed to decode tombstone: {{err}}", err)
+	}
+
+	return tombstone.DeletionTime, true, nil
+}
+
+// TombstoneMatching deletes the items for which match returns true,
+// recording their tombstones, and returns how many were deleted. Each bucket
+// is re-read and updated under its write lock, so items written concurrently
+// are matched against their latest version. It requires
+// Config.RecordTombstones to be set.
+func (s *StoragePacker) TombstoneMatching(ctx context.Context, match func(*Item) bool) (int, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if !s.config.RecordTombstones {
+		return 0, errors.New("tombstones are not recorded by this packer")
+	}
+
+	if match == nil {
+		return 0, errors.New("nil match function")
+	}
+
+	keys, err := s.listBucketKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		removed, err := s.tombstoneMatchingInBucket(ctx, s.BucketPath(key), match)
+		if err != nil {
+			return count, err
+		}
+		count += removed
+	}
+
+	return count, nil
+}
+
+// tombstoneMatchingInBucket removes the items of the bucket stored at
+// bucketPath for which match returns true, and returns how many were removed
+func (s *StoragePacker) tombstoneMatchingInBucket(ctx context.Context, bucketPath string, match func(*Item) bool) (int, error) {
+	lock := locksutil.LockForKey(s.storageLocks, bucketPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	bucket, err := s.decodeBucket(ctx, bucketPath)
+	if err != nil {
+		return 0, err
+	}
+	if bucket == nil {
+		return 0, nil
+	}
+
+	payloadKeys := bucket.payloadKeys()
+
+	var removedIDs []string
+	for _, item := range bucket.Items {
+		item, err := s.loadPayload(ctx, item)
+		if err != nil {
+			return 0, err
+		}
+		if match(item) {
+			removedIDs = append(removedIDs, item.ID)
+		}
+	}
+	if len(removedIDs) == 0 {
+		return 0, nil
+	}
+
+	for _, itemID := range removedIDs {
+		bucket.remove(itemID)
+	}
+
+	if err := s.putBucketRemovingItems(ctx, bucket, bucket.Version, removedIDs); err != nil {
+		return 0, err
+	}
+
+	s.releasePayloads(ctx, bucket, payloadKeys)
+
+	return len(removedIDs), nil
+}
@@ -10,6 +10,7 @@ It is generated from these files:
 It has these top-level messages:
 	Item
 	Bucket
+	Counter
 */
 package storagepacker
 
@@ -17,6 +18,7 @@ import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
 import google_protobuf "github.com/golang/protobuf/ptypes/any"
+import google_protobuf1 "github.com/golang/protobuf/ptypes/timestamp"
 
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
@@ -30,8 +32,11 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Item struct {
-	ID      string               `sentinel:"" protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Message *google_protobuf.Any `sentinel:"" protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	ID             string                      `sentinel:"" protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Message        *google_protobuf.Any        `sentinel:"" protobuf:"bytes,2,opt,name=message" json:"message,omitempty"`
+	LastUpdateTime *google_protobuf1.Timestamp `sentinel:"" protobuf:"bytes,3,opt,name=last_update_time,json=lastUpdateTime" json:"last_update_time,omitempty"`
+	CreationTime   *google_protobuf1.Timestamp `sentinel:"" protobuf:"bytes,4,opt,name=creation_time,json=creationTime" json:"creation_time,omitempty"`
+	PayloadKey     string                      `sentinel:"" protobuf:"bytes,5,opt,name=payload_key,json=payloadKey" json:"payload_key,omitempty"`
 }
 
 func (m *Item) Reset()                    { *m = Item{} }
@@ -53,9 +58,31 @@ func (m *Item) GetMessage() *google_protobuf.Any {
 	return nil
 }
 
+func (m *Item) GetLastUpdateTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.LastUpdateTime
+	}
+	return nil
+}
+
+func (m *Item) GetCreationTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.CreationTime
+	}
+	return nil
+}
+
+func (m *Item) GetPayloadKey() string {
+	if m != nil {
+		return m.PayloadKey
+	}
+	return ""
+}
+
 type Bucket struct {
-	Key   string  `sentinel:"" protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
-	Items []*Item `sentinel:"" protobuf:"bytes,2,rep,name=items" json:"items,omitempty"`
+	Key     string  `sentinel:"" protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Items   []*Item `sentinel:"" protobuf:"bytes,2,rep,name=items" json:"items,omitempty"`
+	Version uint64  `sentinel:"" protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
 }
 
 func (m *Bucket) Reset()                    { *m = Bucket{} }
@@ -77,25 +104,56 @@ func (m *Bucket) GetItems() []*Item {
 	return nil
 }
 
+func (m *Bucket) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+type Counter struct {
+	Value int64 `sentinel:"" protobuf:"varint,1,opt,name=value" json:"value,omitempty"`
+}
+
+func (m *Counter) Reset()                    { *m = Counter{} }
+func (m *Counter) String() string            { return proto.CompactTextString(m) }
+func (*Counter) ProtoMessage()               {}
+func (*Counter) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *Counter) GetValue() int64 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Item)(nil), "storagepacker.Item")
 	proto.RegisterType((*Bucket)(nil), "storagepacker.Bucket")
+	proto.RegisterType((*Counter)(nil), "storagepacker.Counter")
 }
 
 func init() { proto.RegisterFile("types.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 181 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2e, 0xa9, 0x2c, 0x48,
-	0x2d, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x2d, 0x2e, 0xc9, 0x2f, 0x4a, 0x4c, 0x4f,
-	0x2d, 0x48, 0x4c, 0xce, 0x4e, 0x2d, 0x92, 0x92, 0x4c, 0xcf, 0xcf, 0x4f, 0xcf, 0x49, 0xd5, 0x07,
-	0x4b, 0x26, 0x95, 0xa6, 0xe9, 0x27, 0xe6, 0x55, 0x42, 0x54, 0x2a, 0xb9, 0x71, 0xb1, 0x78, 0x96,
-	0xa4, 0xe6, 0x0a, 0xf1, 0x71, 0x31, 0x65, 0xa6, 0x48, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0x31,
-	0x65, 0xa6, 0x08, 0xe9, 0x71, 0xb1, 0xe7, 0xa6, 0x16, 0x17, 0x27, 0xa6, 0xa7, 0x4a, 0x30, 0x29,
-	0x30, 0x6a, 0x70, 0x1b, 0x89, 0xe8, 0x41, 0x0c, 0xd1, 0x83, 0x19, 0xa2, 0xe7, 0x98, 0x57, 0x19,
-	0x04, 0x53, 0xa4, 0xe4, 0xca, 0xc5, 0xe6, 0x54, 0x9a, 0x9c, 0x9d, 0x5a, 0x22, 0x24, 0xc0, 0xc5,
-	0x9c, 0x9d, 0x5a, 0x09, 0x35, 0x0a, 0xc4, 0x14, 0xd2, 0xe4, 0x62, 0xcd, 0x2c, 0x49, 0xcd, 0x2d,
-	0x96, 0x60, 0x52, 0x60, 0xd6, 0xe0, 0x36, 0x12, 0xd6, 0x43, 0x71, 0x9d, 0x1e, 0xc8, 0xfe, 0x20,
-	0x88, 0x8a, 0x24, 0x36, 0xb0, 0xe9, 0xc6, 0x80, 0x00, 0x00, 0x00, 0xff, 0xff, 0x01, 0x30, 0x77,
-	0x9a, 0xce, 0x00, 0x00, 0x00,
+	// 300 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x90, 0xcb, 0x4e, 0xf3, 0x30,
+	0x10, 0x85, 0x95, 0xa4, 0x17, 0xfd, 0x93, 0xbf, 0x55, 0x65, 0xba, 0x08, 0xdd, 0xb4, 0xea, 0xaa,
+	0x6c, 0x5c, 0xa9, 0x3c, 0x00, 0xe2, 0xb2, 0x41, 0xec, 0x22, 0x58, 0x47, 0x6e, 0x33, 0x44, 0x51,
+	0x93, 0xd8, 0xb2, 0x27, 0x95, 0xfc, 0xd2, 0x3c, 0x03, 0xb2, 0x4d, 0x16, 0xc0, 0x82, 0x9d, 0x67,
+	0xe6, 0x9c, 0x6f, 0x7c, 0x06, 0x52, 0xb2, 0x0a, 0x0d, 0x57, 0x5a, 0x92, 0x64, 0x33, 0x43, 0x52,
+	0x8b, 0x0a, 0x95, 0x38, 0x9d, 0x51, 0xaf, 0xae, 0x2b, 0x29, 0xab, 0x06, 0xf7, 0x7e, 0x78, 0xec,
+	0xdf, 0xf7, 0xa2, 0xb3, 0x41, 0xb9, 0x5a, 0xff, 0x1c, 0x51, 0xdd, 0xa2, 0x21, 0xd1, 0xaa, 0x20,
+	0xd8, 0x7e, 0x44, 0x30, 0x7a, 0x26, 0x6c, 0xd9, 0x1c, 0xe2, 0xba, 0xcc, 0xa2, 0x4d, 0xb4, 0xfb,
+	0x97, 0xc7, 0x75, 0xc9, 0x38, 0x4c, 0x5b, 0x34, 0x46, 0x54, 0x98, 0xc5, 0x9b, 0x68, 0x97, 0x1e,
+	0x96, 0x3c, 0xb0, 0xf8, 0xc0, 0xe2, 0xf7, 0x9d, 0xcd, 0x07, 0x11, 0x7b, 0x82, 0x45, 0x23, 0x0c,
+	0x15, 0xbd, 0x2a, 0x05, 0x61, 0xe1, 0xf6, 0x64, 0x89, 0x37, 0xae, 0x7e, 0x19, 0x5f, 0x87, 0x4f,
+	0xe4, 0x73, 0xe7, 0x79, 0xf3, 0x16, 0xd7, 0x64, 0x77, 0x30, 0x3b, 0x69, 0x14, 0x54, 0xcb, 0x2e,
+	0x20, 0x46, 0x7f, 0x22, 0xfe, 0x0f, 0x06, 0x0f, 0x58, 0x43, 0xaa, 0x84, 0x6d, 0xa4, 0x28, 0x8b,
+	0x33, 0xda, 0x6c, 0xec, 0xf3, 0xc0, 0x57, 0xeb, 0x05, 0xed, 0xb6, 0x80, 0xc9, 0x43, 0x7f, 0x3a,
+	0x23, 0xb1, 0x05, 0x24, 0x4e, 0x12, 0x22, 0xbb, 0x27, 0xbb, 0x81, 0x71, 0x4d, 0xd8, 0x9a, 0x2c,
+	0xde, 0x24, 0xbb, 0xf4, 0x70, 0xc5, 0xbf, 0xdd, 0x99, 0xbb, 0x3b, 0xe5, 0x41, 0xc1, 0x32, 0x98,
+	0x5e, 0x50, 0x9b, 0x5a, 0x76, 0x3e, 0xe5, 0x28, 0x1f, 0xca, 0xed, 0x1a, 0xa6, 0x8f, 0xb2, 0xef,
+	0x08, 0x35, 0x5b, 0xc2, 0xf8, 0x22, 0x9a, 0x1e, 0xfd, 0x8e, 0x24, 0x0f, 0xc5, 0x71, 0xe2, 0x43,
+	0xdc, 0x7e, 0x0e, 0x00, 0x6b, 0x89, 0xc4, 0x0d, 0xd3, 0x01, 0x00, 0x00,
 }